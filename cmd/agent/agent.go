@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	socketFlag    string
+	ttlFlag       time.Duration
+	identityFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var AgentCmd = cobra.Command{
+	Use:   "agent -i IDENTITY... [--socket SOCKET] [--ttl DURATION]",
+	Short: "Hold unlocked identities for other yage commands",
+	Long: `Hold unlocked identities for other yage commands.
+
+Passphrases of the identities are asked once when the agent starts. Commands
+run with ` + utils.AgentSocketEnv + ` pointing to the agent socket send it the
+headers of the files they decrypt, so that private keys never leave the agent.
+Only processes of the user running the agent are served.
+
+The agent forgets the identities and exits once the TTL expires.`,
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	AgentCmd.PersistentFlags().StringVar(&socketFlag, "socket", DefaultSocket(), "Unix `SOCKET` to listen on")
+	AgentCmd.PersistentFlags().DurationVar(&ttlFlag, "ttl", time.Hour, "Time after which identities are forgotten, 0 to keep them")
+	AgentCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key to hold")
+
+	if err := AgentCmd.MarkPersistentFlagRequired("identity"); err != nil {
+		panic(err)
+	}
+	for _, f := range []string{"identity", "socket"} {
+		if err := cobra.MarkFlagFilename(AgentCmd.PersistentFlags(), f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// DefaultSocket returns the socket of the agent in the user runtime
+// directory, or in a directory of the temporary directory named after the
+// user id.
+func DefaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "yage", "agent.sock")
+	}
+	return filepath.Join(os.TempDir(), "yage-"+strconv.Itoa(os.Getuid()), "agent.sock")
+}
+
+func Run(_ *cobra.Command, _ []string) error {
+	log.SetFlags(0)
+
+	// Fail before asking for passphrases.
+	if _, err := utils.PeerUID(nil); errors.Is(err, utils.ErrPeerCredentialsUnsupported) {
+		return err
+	}
+
+	var identities []age.Identity
+	for _, name := range identityFlags {
+		ids, err := utils.ParseIdentitiesFile(name, false)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %w", name, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	if err := Unlock(identities); err != nil {
+		return err
+	}
+
+	if err := privateDir(filepath.Dir(socketFlag)); err != nil {
+		return err
+	}
+
+	ln, err := utils.ListenUnix(socketFlag)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), utils.StopSignals...)
+	defer stop()
+
+	if ttlFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ttlFlag)
+		defer cancel()
+	}
+
+	fmt.Printf("%s=%s; export %s;\n", utils.AgentSocketEnv, socketFlag, utils.AgentSocketEnv)
+
+	// Let `eval $(yage agent &)` return while the agent keeps running.
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		os.Stdout.Close()
+	}
+
+	agent := NewAgent(identities)
+	err = agent.Serve(ctx, ln)
+	agent.Forget()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("yage: agent TTL expired, identities forgotten")
+	}
+
+	return err
+}
+
+// privateDir creates dir if needed and checks that only its owner can access
+// it.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	switch {
+	case err != nil:
+		return err
+	case info.Mode()&fs.ModeSymlink != 0 || !info.IsDir():
+		return fmt.Errorf("%s is not a directory", dir)
+	case info.Mode().Perm()&0o077 != 0:
+		return fmt.Errorf("%s is accessible by other users", dir)
+	}
+
+	return nil
+}
+
+// Unlock asks for the passphrases of the encrypted identities by unwrapping
+// a file key wrapped to each of them, which also checks that they work.
+func Unlock(identities []age.Identity) error {
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+
+	for _, id := range identities {
+		recipients, err := utils.IdentitiesToRecipients([]age.Identity{id})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range recipients {
+			stanzas, err := r.Wrap(fileKey)
+			if err != nil {
+				return err
+			}
+			key, err := id.Unwrap(stanzas)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(key, fileKey) {
+				return fmt.Errorf("identity %T failed to unwrap its own file key", id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Agent unwraps file keys for the processes of the user running it.
+type Agent struct {
+	mu         sync.Mutex
+	identities []age.Identity
+	uid        int
+}
+
+// NewAgent returns an agent holding identities, which should be unlocked.
+func NewAgent(identities []age.Identity) *Agent {
+	return &Agent{
+		identities: identities,
+		uid:        os.Getuid(),
+	}
+}
+
+// Forget drops the identities of the agent.
+func (a *Agent) Forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.identities = nil
+}
+
+// Serve serves the requests received on ln until ctx is done.
+func (a *Agent) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			a.handle(conn)
+		}()
+	}
+}
+
+func (a *Agent) handle(conn net.Conn) {
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return
+	}
+
+	encoder := json.NewEncoder(conn)
+
+	if uid, err := utils.PeerUID(conn); err != nil || uid != a.uid {
+		log.Printf("yage: agent: refusing connection of uid %d: %v", uid, err)
+		_ = encoder.Encode(utils.AgentResponse{Error: "permission denied"})
+		return
+	}
+
+	req := utils.AgentRequest{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		_ = encoder.Encode(utils.AgentResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	_ = encoder.Encode(a.Unwrap(req.Stanzas))
+}
+
+// Unwrap returns the response to a request for unwrapping stanzas.
+func (a *Agent) Unwrap(stanzas []*age.Stanza) utils.AgentResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, id := range a.identities {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		} else if err != nil {
+			return utils.AgentResponse{Error: err.Error()}
+		}
+		return utils.AgentResponse{FileKey: fileKey}
+	}
+
+	return utils.AgentResponse{NoMatch: true}
+}
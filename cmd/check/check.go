@@ -0,0 +1,234 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package check
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+// DefaultSecretKeys matches the paths of values which should be encrypted:
+// keys ending with a secret word, following a separator, the start of the key
+// or, capitalized, another camelCase word.
+var DefaultSecretKeys = []string{
+	`(?:(?:^|[._\- "])(?i:pass(?:word|wd)?|secret(?:[_-]?(?:access[_-]?)?key)?|token|api[_-]?key|private[_-]?key|credentials?)|[a-zA-Z0-9](?:Pass(?:word|wd)?|Secret(?:(?:Access)?Key)?|Token|A(?:pi|PI)[_-]?Key|PrivateKey|Credentials?))"?$`,
+}
+
+// DefaultNotSecretKeys matches the paths of values which name or refer to
+// secrets rather than hold them, like secretName, secretKeyRef or
+// existingSecret.
+var DefaultNotSecretKeys = []string{
+	`(?:Name|Ref|[_-](?i:name|ref))"?$`,
+	`(?i)\."?existing[^.\[\]]*$`,
+}
+
+var (
+	jsonFlag          bool
+	secretKeyFlags    []string
+	notSecretKeyFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var CheckCmd = cobra.Command{
+	Use:          "check [FILE...]",
+	Aliases:      []string{"lint"},
+	Short:        "Check that the secrets of YAML files are encrypted",
+	GroupID:      "age",
+	SilenceUsage: true,
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	CheckCmd.PersistentFlags().BoolVar(&jsonFlag, "json", false, "Output as JSON")
+	CheckCmd.PersistentFlags().StringArrayVar(&secretKeyFlags, "secret-key", DefaultSecretKeys, "Regular expression matching the paths of values which must be tagged")
+	CheckCmd.PersistentFlags().StringArrayVar(&notSecretKeyFlags, "not-secret-key", DefaultNotSecretKeys, "Regular expression matching the paths of values which need not be tagged even if matching --secret-key")
+}
+
+// Finding rules.
+const (
+	RulePlaintext         = "plaintext"
+	RuleInvalidCiphertext = "invalid-ciphertext"
+	RuleUnknownAttribute  = "unknown-attribute"
+	RuleUntaggedSecret    = "untagged-secret"
+	RuleNotScalar         = "not-scalar"
+	RuleParseError        = "parse-error"
+)
+
+// Finding describes a problem found in a YAML file. It never holds the value
+// itself.
+type Finding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Document int    `json:"document"`
+	Path     string `json:"path"`
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+func (f Finding) String() string {
+	if f.Path == "" {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", f.File, f.Line, f.Column, f.Rule, f.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s: %s", f.File, f.Line, f.Column, f.Rule, f.Path, f.Message)
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	keys, err := compile(secretKeyFlags)
+	if err != nil {
+		return err
+	}
+	notKeys, err := compile(notSecretKeyFlags)
+	if err != nil {
+		return err
+	}
+
+	findings := []Finding{}
+	for _, name := range args {
+		f, err := checkFile(name, keys, notKeys)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, f...)
+	}
+
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+	}
+
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// checkFile checks the file name, or standard input if name is "-".
+func checkFile(name string, keys, notKeys []*regexp.Regexp) ([]Finding, error) {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open input file %q: %w", name, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return Check(name, in, keys, notKeys), nil
+}
+
+// Check returns the problems found in the YAML documents read from in:
+// tagged values which are not age ciphertexts, unknown tag attributes and
+// untagged values whose path matches one of keys but none of notKeys.
+func Check(name string, in io.Reader, keys, notKeys []*regexp.Regexp) []Finding {
+	var findings []Finding
+
+	decoder := yaml.NewDecoder(in)
+	for doc := 0; ; doc++ {
+		node := yaml.Node{}
+		if err := decoder.Decode(&node); err == io.EOF {
+			break
+		} else if err != nil {
+			return append(findings, Finding{File: name, Document: doc, Rule: RuleParseError, Message: err.Error()})
+		}
+
+		_ = utils.Walk(&node, func(path utils.Path, n *yaml.Node) error {
+			add := func(rule, msg string) {
+				findings = append(findings, Finding{
+					File:     name,
+					Line:     n.Line,
+					Column:   n.Column,
+					Document: doc,
+					Path:     path.String(),
+					Rule:     rule,
+					Message:  msg,
+				})
+			}
+
+			attrs, tagged := utils.ParseAgeTag(n.Tag)
+			if !tagged {
+				if n.Kind == yaml.ScalarNode && n.ShortTag() != "!!null" && n.Value != "" && matchAny(keys, path.String()) && !matchAny(notKeys, path.String()) {
+					add(RuleUntaggedSecret, "value matches a secret key pattern but is not tagged")
+				}
+				return nil
+			}
+
+			for _, a := range attrs {
+				if !utils.IsTagAttribute(a) {
+					add(RuleUnknownAttribute, fmt.Sprintf("unknown tag attribute %q", a))
+				}
+			}
+
+			switch {
+			case n.Kind != yaml.ScalarNode:
+				add(RuleNotScalar, "tagged value is not a scalar")
+				return utils.ErrSkipChildren
+			case !utils.IsAgeArmored(n.Value):
+				add(RulePlaintext, "tagged value is not encrypted")
+			default:
+				if _, err := utils.ParseHeader(strings.NewReader(n.Value)); err != nil {
+					add(RuleInvalidCiphertext, err.Error())
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return findings
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, s := range patterns {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret key pattern %q: %w", s, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
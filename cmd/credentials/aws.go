@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package credentials
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	awsFileFlag      string
+	awsProfileFlag   string
+	awsIdentityFlags []string
+
+	//go:embed aws_examples.txt
+	awsExamples string
+)
+
+var AWSCmd = cobra.Command{
+	Use:   "aws -f FILE [--profile PROFILE]",
+	Short: "Print AWS credentials for credential_process",
+	Long: `Print AWS credentials for credential_process.
+
+The credentials are read from the mapping found at the root of the file or
+under the profile name if --profile is given. Keys are named like in
+~/.aws/credentials (aws_access_key_id, aws_secret_access_key,
+aws_session_token) or like in the credential_process output (AccessKeyId,
+SecretAccessKey, SessionToken, Expiration).`,
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         RunAWS,
+	Example:      awsExamples,
+}
+
+func init() {
+	AWSCmd.PersistentFlags().StringVarP(&awsFileFlag, "file", "f", "", "YAML file to read credentials from")
+	AWSCmd.PersistentFlags().StringVar(&awsProfileFlag, "profile", "", "Read credentials under this key")
+	AWSCmd.PersistentFlags().StringArrayVarP(&awsIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	if err := AWSCmd.MarkPersistentFlagRequired("file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(AWSCmd.PersistentFlags(), "file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(AWSCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunAWS(_ *cobra.Command, _ []string) error {
+	log.SetFlags(0)
+
+	identities, err := decrypt.Identities(awsIdentityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	var path utils.Path
+	if awsProfileFlag != "" {
+		path = path.Child(utils.PathElem{Key: awsProfileFlag})
+	}
+
+	values, err := Values(identities, awsFileFlag, path)
+	if err != nil {
+		return err
+	}
+
+	creds, err := NewAWSCredentials(values)
+	if err != nil {
+		return fmt.Errorf("%s: %w", awsFileFlag, err)
+	}
+
+	return writeJSON(os.Stdout, creds)
+}
+
+// AWSCredentials is the document credential_process commands print.
+type AWSCredentials struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken,omitempty"`
+	Expiration      string `json:"Expiration,omitempty"`
+}
+
+// NewAWSCredentials returns the credentials held in values.
+func NewAWSCredentials(values map[string]string) (*AWSCredentials, error) {
+	creds := &AWSCredentials{
+		Version:         1,
+		AccessKeyID:     lookup(values, "aws_access_key_id", "AccessKeyId"),
+		SecretAccessKey: lookup(values, "aws_secret_access_key", "SecretAccessKey"),
+		SessionToken:    lookup(values, "aws_session_token", "SessionToken"),
+		Expiration:      lookup(values, "aws_expiration", "Expiration"),
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("missing access key id or secret access key")
+	}
+
+	return creds, nil
+}
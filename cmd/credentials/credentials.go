@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var CredentialsCmd = cobra.Command{
+	Use:          "credentials",
+	Aliases:      []string{"creds"},
+	Short:        "Credential helpers for tools reading credentials from a command",
+	GroupID:      "age",
+	SilenceUsage: true,
+}
+
+func init() {
+	CredentialsCmd.AddCommand(&AWSCmd)
+	CredentialsCmd.AddCommand(&KubeCmd)
+	CredentialsCmd.AddCommand(&DockerCmd)
+	CredentialsCmd.AddCommand(&GitCmd)
+	CredentialsCmd.AddCommand(&InitStoreCmd)
+}
+
+// Values decrypts the first document of the YAML file name and returns the
+// scalar values of the mapping found at path.
+func Values(identities []age.Identity, name string, path utils.Path) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	docs, err := decrypt.DecryptDocuments(identities, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("%s: %w: %s", name, utils.ErrPathNotFound, path)
+	}
+
+	node, err := utils.Lookup(docs[0].Node, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: %s is not a mapping", name, path)
+	}
+
+	values := map[string]string{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		v := node.Content[i+1]
+		for v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		if v.Kind == yaml.ScalarNode {
+			values[node.Content[i].Value] = v.Value
+		}
+	}
+
+	return values, nil
+}
+
+// lookup returns the first value of values found under one of names.
+func lookup(values map[string]string, names ...string) string {
+	for _, n := range names {
+		if v, ok := values[n]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func writeJSON(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("json encoding failed: %w", err)
+	}
+	return nil
+}
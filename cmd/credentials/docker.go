@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package credentials
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+)
+
+var (
+	//go:embed docker_examples.txt
+	dockerExamples string
+)
+
+var DockerCmd = cobra.Command{
+	Use:   "docker get|store|erase|list",
+	Short: "Docker credential helper backed by a yage credential store",
+	Long: `Docker credential helper backed by a yage credential store.
+
+When invoked as docker-credential-yage, yage runs this command so that it can
+be used as a docker credential helper. The store and the identities are then
+taken from the environment.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	ValidArgs:     []string{"get", "store", "erase", "list"},
+	Args:          cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	Run:           RunDocker,
+	Example:       dockerExamples,
+}
+
+func init() {
+	addStoreFlags(&DockerCmd, true)
+}
+
+// DockerSection is the section of the credential store holding docker
+// credentials.
+const DockerSection = "docker"
+
+// ErrDockerCredentialsNotFound is the error docker expects when a helper
+// doesn't have credentials for a server.
+var ErrDockerCredentialsNotFound = errors.New("credentials not found in native keychain")
+
+// DockerCredentials is the credentials document of the docker credential
+// helper protocol.
+type DockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func RunDocker(_ *cobra.Command, args []string) {
+	// Docker reads errors from stdout.
+	if err := Docker(args[0], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stdout, err)
+		os.Exit(1)
+	}
+}
+
+// Docker runs the docker credential helper action reading its input from in
+// and writing its output to out.
+func Docker(action string, in io.Reader, out io.Writer) error {
+	store, err := OpenStore(storeFileFlag)
+	if errors.Is(err, ErrStoreNotFound) && (action == "get" || action == "list" || action == "erase") {
+		store = &Store{Name: storeFileFlag}
+	} else if err != nil {
+		return err
+	}
+
+	switch action {
+	case "get":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+
+		identities, err := decrypt.Identities(storeIdentities(), true)
+		if err != nil {
+			return err
+		}
+
+		e, err := store.Get(identities, DockerSection, serverURL)
+		if err != nil {
+			return err
+		} else if e == nil {
+			return ErrDockerCredentialsNotFound
+		}
+
+		return json.NewEncoder(out).Encode(DockerCredentials{ServerURL: serverURL, Username: e.Username, Secret: e.Secret})
+	case "store":
+		creds := DockerCredentials{}
+		if err := json.NewDecoder(in).Decode(&creds); err != nil {
+			return fmt.Errorf("invalid credentials: %w", err)
+		}
+		if creds.ServerURL == "" {
+			return fmt.Errorf("no credentials server URL")
+		}
+
+		return store.Put(DockerSection, creds.ServerURL, Entry{Username: creds.Username, Secret: creds.Secret})
+	case "erase":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+
+		return store.Erase(DockerSection, serverURL)
+	case "list":
+		return json.NewEncoder(out).Encode(store.List(DockerSection))
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+func readServerURL(in io.Reader) (string, error) {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+
+	serverURL := strings.TrimSpace(string(b))
+	if serverURL == "" {
+		return "", fmt.Errorf("no credentials server URL")
+	}
+
+	return serverURL, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package credentials
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+)
+
+var (
+	//go:embed git_examples.txt
+	gitExamples string
+)
+
+var GitCmd = cobra.Command{
+	Use:   "git get|store|erase",
+	Short: "Git credential helper backed by a yage credential store",
+	Long: `Git credential helper backed by a yage credential store.
+
+When invoked as git-credential-yage, yage runs this command so that it can be
+used as a git credential helper. Credentials are indexed by protocol, host and
+path when git gives one, see credential.useHttpPath.`,
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(1),
+	RunE:         RunGit,
+	Example:      gitExamples,
+}
+
+func init() {
+	addStoreFlags(&GitCmd, true)
+}
+
+// GitSection is the section of the credential store holding git
+// credentials.
+const GitSection = "git"
+
+func RunGit(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	return Git(args[0], os.Stdin, os.Stdout)
+}
+
+// Git runs the git credential helper action reading its input from in and
+// writing its output to out. Unknown actions are ignored as the protocol
+// requires.
+func Git(action string, in io.Reader, out io.Writer) error {
+	switch action {
+	case "get", "store", "erase":
+	default:
+		return nil
+	}
+
+	attrs, err := ReadGitCredential(in)
+	if err != nil {
+		return err
+	}
+
+	key, err := GitKey(attrs)
+	if err != nil {
+		return err
+	}
+
+	store, err := OpenStore(storeFileFlag)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "get":
+		identities, err := decrypt.Identities(storeIdentities(), true)
+		if err != nil {
+			return err
+		}
+
+		e, err := store.Get(identities, GitSection, key)
+		if err != nil || e == nil {
+			return err
+		}
+		if attrs["username"] != "" && attrs["username"] != e.Username {
+			return nil
+		}
+
+		_, err = fmt.Fprintf(out, "username=%s\npassword=%s\n", e.Username, e.Secret)
+		return err
+	case "store":
+		if attrs["password"] == "" {
+			return nil
+		}
+		return store.Put(GitSection, key, Entry{Username: attrs["username"], Secret: attrs["password"]})
+	default:
+		if username, ok := store.List(GitSection)[key]; !ok || (attrs["username"] != "" && attrs["username"] != username) {
+			return nil
+		}
+		return store.Erase(GitSection, key)
+	}
+}
+
+// ReadGitCredential reads the attributes of a git credential description up
+// to the first blank line.
+func ReadGitCredential(in io.Reader) (map[string]string, error) {
+	attrs := map[string]string{}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid credential line %q", line)
+		}
+		attrs[k] = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if u, ok := attrs["url"]; ok {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential url: %w", err)
+		}
+		for k, v := range map[string]string{
+			"protocol": parsed.Scheme,
+			"host":     parsed.Host,
+			"path":     strings.TrimPrefix(parsed.Path, "/"),
+			"username": parsed.User.Username(),
+		} {
+			if _, ok := attrs[k]; !ok && v != "" {
+				attrs[k] = v
+			}
+		}
+	}
+
+	return attrs, nil
+}
+
+// GitKey returns the key of the credential described by attrs in the store.
+func GitKey(attrs map[string]string) (string, error) {
+	if attrs["protocol"] == "" || attrs["host"] == "" {
+		return "", fmt.Errorf("credential protocol and host are required")
+	}
+
+	key := attrs["protocol"] + "://" + attrs["host"]
+	if attrs["path"] != "" {
+		key += "/" + attrs["path"]
+	}
+
+	return key, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package credentials
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	kubeFileFlag       string
+	kubePathFlag       string
+	kubeAPIVersionFlag string
+	kubeIdentityFlags  []string
+
+	//go:embed kube_examples.txt
+	kubeExamples string
+)
+
+var KubeCmd = cobra.Command{
+	Use:   "kube -f FILE [--path PATH]",
+	Short: "Print a Kubernetes ExecCredential for kubeconfig exec plugins",
+	Long: `Print a Kubernetes ExecCredential for kubeconfig exec plugins.
+
+The credentials are read from the mapping found at --path. Keys are named like
+in the ExecCredential status (token, clientCertificateData, clientKeyData,
+expirationTimestamp) or like in kubeconfig users (token,
+client-certificate-data, client-key-data, base64 encoded). The API version is taken from
+KUBERNETES_EXEC_INFO when kubectl sets it.`,
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         RunKube,
+	Example:      kubeExamples,
+}
+
+func init() {
+	KubeCmd.PersistentFlags().StringVarP(&kubeFileFlag, "file", "f", "", "YAML file to read credentials from")
+	KubeCmd.PersistentFlags().StringVar(&kubePathFlag, "path", ".", "Path of the credentials in the file")
+	KubeCmd.PersistentFlags().StringVar(&kubeAPIVersionFlag, "api-version", DefaultExecCredentialAPIVersion, "ExecCredential API version if KUBERNETES_EXEC_INFO is not set")
+	KubeCmd.PersistentFlags().StringArrayVarP(&kubeIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	if err := KubeCmd.MarkPersistentFlagRequired("file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(KubeCmd.PersistentFlags(), "file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(KubeCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+// DefaultExecCredentialAPIVersion is the API version of the ExecCredential
+// objects printed when kubectl doesn't tell which one it expects.
+const DefaultExecCredentialAPIVersion = "client.authentication.k8s.io/v1"
+
+func RunKube(_ *cobra.Command, _ []string) error {
+	log.SetFlags(0)
+
+	path, err := utils.ParsePath(kubePathFlag)
+	if err != nil {
+		return err
+	}
+
+	apiVersion := kubeAPIVersionFlag
+	if info := os.Getenv("KUBERNETES_EXEC_INFO"); info != "" {
+		cred := ExecCredential{}
+		if err := json.Unmarshal([]byte(info), &cred); err != nil {
+			return fmt.Errorf("invalid KUBERNETES_EXEC_INFO: %w", err)
+		}
+		if cred.APIVersion != "" {
+			apiVersion = cred.APIVersion
+		}
+	}
+
+	identities, err := decrypt.Identities(kubeIdentityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	values, err := Values(identities, kubeFileFlag, path)
+	if err != nil {
+		return err
+	}
+
+	cred, err := NewExecCredential(apiVersion, values)
+	if err != nil {
+		return fmt.Errorf("%s: %w", kubeFileFlag, err)
+	}
+
+	return writeJSON(os.Stdout, cred)
+}
+
+// ExecCredential is a client.authentication.k8s.io ExecCredential object.
+type ExecCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *ExecCredentialStatus `json:"status,omitempty"`
+}
+
+// ExecCredentialStatus holds the credentials of an ExecCredential.
+type ExecCredentialStatus struct {
+	ExpirationTimestamp   string `json:"expirationTimestamp,omitempty"`
+	Token                 string `json:"token,omitempty"`
+	ClientCertificateData string `json:"clientCertificateData,omitempty"`
+	ClientKeyData         string `json:"clientKeyData,omitempty"`
+}
+
+// NewExecCredential returns an ExecCredential holding the credentials found
+// in values.
+func NewExecCredential(apiVersion string, values map[string]string) (*ExecCredential, error) {
+	status := &ExecCredentialStatus{
+		ExpirationTimestamp:   lookup(values, "expirationTimestamp", "expiration-timestamp"),
+		Token:                 lookup(values, "token"),
+		ClientCertificateData: lookup(values, "clientCertificateData"),
+		ClientKeyData:         lookup(values, "clientKeyData"),
+	}
+
+	// kubeconfig holds base64 encoded PEM where ExecCredential holds PEM.
+	for field, key := range map[*string]string{
+		&status.ClientCertificateData: "client-certificate-data",
+		&status.ClientKeyData:         "client-key-data",
+	} {
+		if v, ok := values[key]; ok && *field == "" {
+			data, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			*field = string(data)
+		}
+	}
+
+	hasCert, hasKey := status.ClientCertificateData != "", status.ClientKeyData != ""
+	switch {
+	case hasCert != hasKey:
+		return nil, fmt.Errorf("client certificate and key must be given together")
+	case status.Token == "" && !hasCert:
+		return nil, fmt.Errorf("missing token or client certificate")
+	}
+
+	return &ExecCredential{
+		APIVersion: apiVersion,
+		Kind:       "ExecCredential",
+		Status:     status,
+	}, nil
+}
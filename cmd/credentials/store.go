@@ -0,0 +1,335 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package credentials
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/cmd/set"
+	"sylr.dev/yage/v2/utils"
+	yage "sylr.dev/yaml/age/v3"
+)
+
+const (
+	// StoreFileEnv names the variable holding the credential store file
+	// used when --file is not given.
+	StoreFileEnv = "YAGE_CREDENTIALS_FILE"
+	// IdentityEnv names the variable holding identity files, separated like
+	// PATH, used when --identity is not given.
+	IdentityEnv = "YAGE_IDENTITY"
+)
+
+var (
+	storeFileFlag           string
+	storeIdentityFlags      []string
+	storeRecipientFlags     []string
+	storeRecipientFileFlags []string
+
+	//go:embed init_store_examples.txt
+	initStoreExamples string
+)
+
+var InitStoreCmd = cobra.Command{
+	Use:   "init-store [-f FILE] (-r RECIPIENT | -R PATH)...",
+	Short: "Create the credential store of the docker and git helpers",
+	Long: `Create the credential store of the docker and git helpers.
+
+The recipients are written in the store so that the helpers can encrypt new
+credentials without being told who to encrypt them to.`,
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         RunInitStore,
+	Example:      initStoreExamples,
+}
+
+func init() {
+	InitStoreCmd.PersistentFlags().StringArrayVarP(&storeRecipientFlags, "recipient", "r", []string{}, "Encrypt credentials to the specified RECIPIENT")
+	InitStoreCmd.PersistentFlags().StringArrayVarP(&storeRecipientFileFlags, "recipient-file", "R", []string{}, "Encrypt credentials to recipients listed at PATH")
+
+	if err := cobra.MarkFlagFilename(InitStoreCmd.PersistentFlags(), "recipient-file"); err != nil {
+		panic(err)
+	}
+
+	addStoreFlags(&InitStoreCmd, false)
+}
+
+// addStoreFlags adds the flags selecting the credential store and the
+// identities to cmd.
+func addStoreFlags(cmd *cobra.Command, identity bool) {
+	cmd.PersistentFlags().StringVarP(&storeFileFlag, "file", "f", DefaultStoreFile(), fmt.Sprintf("Credential store file (env %s)", StoreFileEnv))
+	if err := cobra.MarkFlagFilename(cmd.PersistentFlags(), "file"); err != nil {
+		panic(err)
+	}
+
+	if identity {
+		cmd.PersistentFlags().StringArrayVarP(&storeIdentityFlags, "identity", "i", []string{}, fmt.Sprintf("Identity private key for decrypting (env %s)", IdentityEnv))
+		if err := cobra.MarkFlagFilename(cmd.PersistentFlags(), "identity"); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// DefaultStoreFile returns the credential store file named by StoreFileEnv,
+// or credentials.yaml in the yage directory of the user configuration
+// directory.
+func DefaultStoreFile() string {
+	if name := os.Getenv(StoreFileEnv); name != "" {
+		return name
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "credentials.yaml"
+	}
+
+	return filepath.Join(dir, "yage", "credentials.yaml")
+}
+
+// storeIdentities returns the identity files given with --identity or in
+// IdentityEnv.
+func storeIdentities() []string {
+	if len(storeIdentityFlags) > 0 {
+		return storeIdentityFlags
+	}
+	return filepath.SplitList(os.Getenv(IdentityEnv))
+}
+
+func RunInitStore(_ *cobra.Command, _ []string) error {
+	log.SetFlags(0)
+
+	keys := append([]string{}, storeRecipientFlags...)
+	for _, name := range storeRecipientFileFlags {
+		lines, err := utils.ReadRecipientLines(name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, lines...)
+	}
+
+	content, err := NewStore(keys)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(storeFileFlag); err == nil {
+		return fmt.Errorf("credential store %q exists", storeFileFlag)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(storeFileFlag), 0o700); err != nil {
+		return err
+	}
+
+	f := utils.NewLazyOpenerPerm(storeFileFlag, false, 0o600)
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// NewStore returns the content of an empty credential store encrypting
+// credentials to the recipients keys.
+func NewStore(keys []string) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("missing recipients")
+	}
+	if _, err := encrypt.Recipients(keys, nil, nil, false); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBufferString("# yage credential store\n")
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+
+	if err := encoder.Encode(struct {
+		Recipients []string `yaml:"recipients"`
+	}{keys}); err != nil {
+		return nil, fmt.Errorf("yaml encoding failed: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("yaml encoding close failed: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Store is a YAML file holding credentials indexed by section and key. The
+// secrets are encrypted to the recipients listed in the file.
+//
+//	recipients:
+//	- age1...
+//	docker:
+//	  https://index.docker.io/v1/:
+//	    username: me
+//	    secret: !crypto/age ...
+type Store struct {
+	Name string
+
+	src []byte
+	doc yaml.Node
+}
+
+// Entry is a credential held in a Store.
+type Entry struct {
+	Username string `yaml:"username"`
+	Secret   string `yaml:"secret"`
+}
+
+// ErrStoreNotFound is returned by OpenStore when the store file is missing.
+var ErrStoreNotFound = errors.New("credential store not found")
+
+// OpenStore reads the credential store name.
+func OpenStore(name string) (*Store, error) {
+	src, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s, create it with yage credentials init-store", ErrStoreNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read credential store: %w", err)
+	}
+
+	s := &Store{Name: name}
+	if err := s.load(src); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load(src []byte) error {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return fmt.Errorf("%s: yaml decoding failed: %w", s.Name, err)
+	}
+
+	s.src, s.doc = src, doc
+	return nil
+}
+
+func (s *Store) save(src []byte) error {
+	if err := utils.WriteFileAtomic(s.Name, src, 0o600); err != nil {
+		return err
+	}
+	return s.load(src)
+}
+
+// Recipients returns the recipients listed in the store.
+func (s *Store) Recipients() ([]age.Recipient, error) {
+	node, err := utils.Lookup(&s.doc, utils.Path{{Key: "recipients"}})
+	if errors.Is(err, utils.ErrPathNotFound) {
+		return nil, fmt.Errorf("%s: no recipients in the credential store", s.Name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := node.Decode(&keys); err != nil {
+		return nil, fmt.Errorf("%s: invalid recipients: %w", s.Name, err)
+	}
+
+	return encrypt.Recipients(keys, nil, nil, false)
+}
+
+// Get returns the entry of section found under key, or nil.
+func (s *Store) Get(identities []age.Identity, section, key string) (*Entry, error) {
+	node, err := utils.Lookup(&s.doc, utils.Path{{Key: section}, {Key: key}})
+	if errors.Is(err, utils.ErrPathNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	value := yaml.Node{}
+	w := yage.Wrapper{Value: &value, Identities: identities, ForceNoTag: true}
+	if err := node.Decode(&w); err != nil {
+		return nil, fmt.Errorf("%s: failed to decrypt: %w", s.Name, err)
+	}
+
+	e := &Entry{}
+	if err := value.Decode(e); err != nil {
+		return nil, fmt.Errorf("%s: invalid entry %q: %w", s.Name, key, err)
+	}
+
+	return e, nil
+}
+
+// List returns the usernames of the entries of section indexed by key.
+func (s *Store) List(section string) map[string]string {
+	list := map[string]string{}
+
+	node, err := utils.Lookup(&s.doc, utils.Path{{Key: section}})
+	if err != nil || node.Kind != yaml.MappingNode {
+		return list
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		_, username := utils.MappingEntry(node.Content[i+1], "username")
+		if username != nil {
+			list[node.Content[i].Value] = username.Value
+		} else {
+			list[node.Content[i].Value] = ""
+		}
+	}
+
+	return list
+}
+
+// Put writes e under key in section, its secret encrypted to the recipients
+// of the store.
+func (s *Store) Put(section, key string, e Entry) error {
+	recipients, err := s.Recipients()
+	if err != nil {
+		return err
+	}
+
+	path := utils.Path{{Key: section}, {Key: key}}
+
+	src, err := utils.SetYAMLValue(s.src, path.Child(utils.PathElem{Key: "username"}), "", e.Username)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+	if src, err = set.Set(recipients, src, path.Child(utils.PathElem{Key: "secret"}), e.Secret, nil); err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+
+	return s.save(src)
+}
+
+// Erase removes the entry of section found under key, and section if it
+// becomes empty.
+func (s *Store) Erase(section, key string) error {
+	list := s.List(section)
+	if _, ok := list[key]; !ok {
+		return nil
+	}
+
+	path := utils.Path{{Key: section}}
+	if len(list) > 1 {
+		path = path.Child(utils.PathElem{Key: key})
+	}
+
+	src, err := utils.DeleteYAMLValue(s.src, path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+
+	return s.save(src)
+}
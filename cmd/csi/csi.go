@@ -0,0 +1,339 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package csi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sylr.dev/yage/v2/cmd/csi/v1alpha1"
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/get"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	listenFlag    string
+	timeoutFlag   time.Duration
+	identityFlags []string
+	identityDir   string
+
+	//go:embed examples.txt
+	examples string
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative v1alpha1/service.proto
+
+// NamespaceAttribute is the mount attribute holding the namespace of the pod.
+const NamespaceAttribute = "csi.storage.k8s.io/pod.namespace"
+
+var CSIProviderCmd = cobra.Command{
+	Use:   "csi-provider --listen SOCKET (-i IDENTITY | --identity-dir DIR)",
+	Short: "Run a Secrets Store CSI driver provider decrypting with age",
+	Long: `Run a Secrets Store CSI driver provider decrypting with age.
+
+The encrypted YAML documents and the paths of the values to mount are read
+from the "objects" parameter of the SecretProviderClass, and decrypted with the
+identities of the node.
+
+Anyone allowed to create a SecretProviderClass and a pod in a namespace can
+have any value the provider can decrypt mounted in the pod. Identities given
+with --identity are used for pods of all namespaces, so values encrypted to
+them must be readable by all of them. Identities read from the file named
+after the namespace of the pod in --identity-dir are only used for pods of
+that namespace; encrypt values to the recipients of a namespace to restrict
+them to it.`,
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	CSIProviderCmd.PersistentFlags().StringVar(&listenFlag, "listen", "/etc/kubernetes/secrets-store-csi-providers/yage.sock", "Unix `SOCKET` to listen on")
+	CSIProviderCmd.PersistentFlags().DurationVar(&timeoutFlag, "timeout", 10*time.Second, "Connection timeout")
+	CSIProviderCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting for all namespaces")
+	CSIProviderCmd.PersistentFlags().StringVar(&identityDir, "identity-dir", "", "`DIR` holding one identity file per namespace")
+
+	CSIProviderCmd.MarkFlagsOneRequired("identity", "identity-dir")
+	if err := cobra.MarkFlagDirname(CSIProviderCmd.PersistentFlags(), "identity-dir"); err != nil {
+		panic(err)
+	}
+	for _, f := range []string{"identity", "listen"} {
+		if err := cobra.MarkFlagFilename(CSIProviderCmd.PersistentFlags(), f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func Run(_ *cobra.Command, _ []string) error {
+	log.SetFlags(log.LstdFlags)
+
+	var identities []age.Identity
+	for _, name := range identityFlags {
+		ids, err := utils.ParseIdentitiesFile(name, true)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %w", name, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	ln, err := utils.ListenUnix(listenFlag)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), utils.StopSignals...)
+	defer stop()
+
+	log.Printf("yage: csi-provider listening on %s", listenFlag)
+
+	return NewProvider(identities, identityDir).Serve(ctx, ln, timeoutFlag)
+}
+
+// Object is an entry of the "objects" SecretProviderClass parameter.
+type Object struct {
+	// ObjectName names the file holding the whole decrypted document when
+	// no paths are given.
+	ObjectName string `yaml:"objectName"`
+	// YAML is the encrypted YAML document.
+	YAML  string       `yaml:"yaml"`
+	Paths []ObjectPath `yaml:"paths"`
+	// Mode is the octal mode of the file of the whole document.
+	Mode string `yaml:"mode"`
+}
+
+// ObjectPath selects a value of an Object written to its own file.
+type ObjectPath struct {
+	Path     string `yaml:"path"`
+	FileName string `yaml:"fileName"`
+	// Mode is the octal mode of the file.
+	Mode string `yaml:"mode"`
+}
+
+// Provider implements the provider API of the Secrets Store CSI driver.
+type Provider struct {
+	v1alpha1.UnimplementedCSIDriverProviderServer
+
+	identities  []age.Identity
+	identityDir string
+}
+
+// NewProvider returns a provider decrypting with identities for pods of all
+// namespaces, and with the identities of the file named after the namespace
+// in identityDir, if not empty, for pods of that namespace.
+func NewProvider(identities []age.Identity, identityDir string) *Provider {
+	return &Provider{identities: identities, identityDir: identityDir}
+}
+
+// Serve serves the provider gRPC API on ln until ctx is done.
+func (p *Provider) Serve(ctx context.Context, ln net.Listener, timeout time.Duration) error {
+	server := grpc.NewServer(grpc.ConnectionTimeout(timeout))
+	v1alpha1.RegisterCSIDriverProviderServer(server, p)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.GracefulStop()
+		case <-done:
+		}
+	}()
+
+	if err := server.Serve(ln); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// Version returns the version of the provider API and of yage.
+func (p *Provider) Version(_ context.Context, _ *v1alpha1.VersionRequest) (*v1alpha1.VersionResponse, error) {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+
+	return &v1alpha1.VersionResponse{
+		Version:        "v1alpha1",
+		RuntimeName:    "yage",
+		RuntimeVersion: version,
+	}, nil
+}
+
+// Mount returns the files of the objects of the SecretProviderClass.
+func (p *Provider) Mount(_ context.Context, req *v1alpha1.MountRequest) (*v1alpha1.MountResponse, error) {
+	attributes := map[string]string{}
+	if err := json.Unmarshal([]byte(req.Attributes), &attributes); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid attributes: %v", err)
+	}
+
+	identities, err := p.namespaceIdentities(attributes[NamespaceAttribute])
+	if err != nil {
+		return nil, err
+	}
+
+	var perm int32 = 0o644
+	if req.Permission != "" {
+		if err := json.Unmarshal([]byte(req.Permission), &perm); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid permission: %v", err)
+		}
+	}
+
+	var objects []Object
+	if err := yaml.Unmarshal([]byte(attributes["objects"]), &objects); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid objects parameter: %v", err)
+	}
+
+	res := &v1alpha1.MountResponse{}
+	seen := map[string]bool{}
+
+	for i, obj := range objects {
+		files, err := objectFiles(identities, obj, perm)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "object %d: %v", i, err)
+		}
+
+		for _, f := range files {
+			if seen[f.Path] {
+				return nil, status.Errorf(codes.InvalidArgument, "object %d: file %q is mounted twice", i, f.Path)
+			}
+			seen[f.Path] = true
+
+			sum := sha256.Sum256(append([]byte(obj.YAML), f.Path...))
+			res.Files = append(res.Files, f)
+			res.ObjectVersion = append(res.ObjectVersion, &v1alpha1.ObjectVersion{
+				Id:      f.Path,
+				Version: hex.EncodeToString(sum[:8]),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+// namespaceRegexp matches Kubernetes namespace names.
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// namespaceIdentities returns the identities decrypting objects for pods of
+// namespace: the identities of all namespaces and those of the file named
+// after namespace in the identity directory.
+func (p *Provider) namespaceIdentities(namespace string) ([]age.Identity, error) {
+	identities := p.identities
+
+	if p.identityDir != "" {
+		if !namespaceRegexp.MatchString(namespace) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s attribute %q", NamespaceAttribute, namespace)
+		}
+
+		name := filepath.Join(p.identityDir, namespace)
+		if _, err := os.Stat(name); err == nil {
+			ids, err := utils.ParseIdentitiesFile(name, true)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "error reading identities of namespace %q: %v", namespace, err)
+			}
+			identities = append(ids, identities...)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, status.Errorf(codes.Internal, "error reading identities of namespace %q: %v", namespace, err)
+		}
+	}
+
+	if len(identities) == 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "no identity for namespace %q", namespace)
+	}
+
+	return identities, nil
+}
+
+// objectFiles returns the files of obj decrypted with identities, written
+// with perm unless the object gives a mode.
+func objectFiles(identities []age.Identity, obj Object, perm int32) ([]*v1alpha1.File, error) {
+	docs, err := decrypt.DecryptDocuments(identities, strings.NewReader(obj.YAML))
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no YAML document found")
+	}
+
+	paths := obj.Paths
+	if len(paths) == 0 {
+		paths = []ObjectPath{{Path: ".", FileName: obj.ObjectName, Mode: obj.Mode}}
+	}
+
+	var files []*v1alpha1.File
+	for _, op := range paths {
+		if op.FileName == "" || !filepath.IsLocal(op.FileName) {
+			return nil, fmt.Errorf("invalid file name %q", op.FileName)
+		}
+
+		mode := perm
+		if op.Mode != "" {
+			m, err := strconv.ParseInt(op.Mode, 8, 32)
+			if err != nil || m&^0o777 != 0 {
+				return nil, fmt.Errorf("%s: invalid mode %q", op.FileName, op.Mode)
+			}
+			mode = int32(m)
+		}
+
+		path, err := utils.ParsePath(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		node, err := utils.Lookup(docs[0].Node, path)
+		if err != nil {
+			return nil, err
+		}
+
+		var contents []byte
+		if node.Kind == yaml.ScalarNode {
+			contents = []byte(node.Value)
+		} else {
+			buf := &bytes.Buffer{}
+			if err := get.WriteNode(buf, node, false); err != nil {
+				return nil, err
+			}
+			contents = buf.Bytes()
+		}
+
+		files = append(files, &v1alpha1.File{
+			Path:     filepath.ToSlash(op.FileName),
+			Mode:     mode,
+			Contents: contents,
+		})
+	}
+
+	return files, nil
+}
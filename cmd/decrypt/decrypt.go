@@ -15,6 +15,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 
 	"filippo.io/age"
 	"filippo.io/age/armor"
@@ -32,7 +34,16 @@ var (
 	yamlFlag             bool
 	yamlNoTagFlag        bool
 	yamlDiscardNoTagFlag bool
+	resolveRefsFlag      bool
 	identityFlags        []string
+	fileFlag             string
+	toDirFlag            string
+	pathFlags            []string
+	ownerFlag            string
+	watchFlag            bool
+	signalPIDFlag        int
+	signalFlag           string
+	hookFlag             string
 
 	//go:embed examples.txt
 	examples string
@@ -57,16 +68,54 @@ func init() {
 	DecryptCmd.PersistentFlags().BoolVarP(&yamlFlag, "yaml", "y", false, "In-place yaml decrypting")
 	DecryptCmd.PersistentFlags().BoolVar(&yamlNoTagFlag, "yaml-notag", false, "Strip !crypto/age tag from output")
 	DecryptCmd.PersistentFlags().BoolVar(&yamlDiscardNoTagFlag, "yaml-discard-notag", false, "Do not honour NoTag YAML tag attribute")
+	DecryptCmd.PersistentFlags().BoolVar(&resolveRefsFlag, "resolve-refs", false, "Resolve the references to values of files of the input directory")
+	DecryptCmd.PersistentFlags().StringVarP(&fileFlag, "file", "f", "", "Input `FILE`, same as the argument")
+	DecryptCmd.PersistentFlags().StringVar(&toDirFlag, "to-dir", "", "Write the YAML values to their own file of `DIR`")
+	DecryptCmd.PersistentFlags().StringArrayVar(&pathFlags, "path", []string{}, "Path of the values written with --to-dir (default \".\")")
+	DecryptCmd.PersistentFlags().StringVar(&ownerFlag, "owner", "", "Owner of the files written with --to-dir, as `USER[:GROUP]`")
+	DecryptCmd.PersistentFlags().BoolVarP(&watchFlag, "watch", "w", false, "Decrypt again when the input or identity files change")
+	DecryptCmd.PersistentFlags().IntVar(&signalPIDFlag, "signal-pid", 0, "Signal the process `PID` after decrypting again with --watch")
+	DecryptCmd.PersistentFlags().StringVar(&signalFlag, "signal", "HUP", "`SIGNAL` sent with --signal-pid")
+	DecryptCmd.PersistentFlags().StringVar(&hookFlag, "hook", "", "Run `COMMAND` with the shell after decrypting again with --watch")
 
 	if err := cobra.MarkFlagFilename(DecryptCmd.PersistentFlags(), "identity"); err != nil {
 		panic(err)
 	}
+	if err := cobra.MarkFlagFilename(DecryptCmd.PersistentFlags(), "file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagDirname(DecryptCmd.PersistentFlags(), "to-dir"); err != nil {
+		panic(err)
+	}
 }
 
-func Validate(_ *cobra.Command, _ []string) error {
+func Validate(_ *cobra.Command, args []string) error {
 	if yamlNoTagFlag && yamlDiscardNoTagFlag {
 		return fmt.Errorf("can't use --yaml-notag and --yaml-discard-notag simultaneously.")
 	}
+	if fileFlag != "" && len(args) > 0 {
+		return fmt.Errorf("can't use --file and an input file argument simultaneously")
+	}
+	if toDirFlag != "" && outFlag != "" {
+		return fmt.Errorf("can't use --to-dir and --output simultaneously")
+	}
+	if toDirFlag == "" && (len(pathFlags) > 0 || ownerFlag != "") {
+		return fmt.Errorf("--path and --owner require --to-dir")
+	}
+	if resolveRefsFlag && !yamlFlag && toDirFlag == "" {
+		return fmt.Errorf("--resolve-refs requires --yaml or --to-dir")
+	}
+	if !watchFlag && (signalPIDFlag != 0 || hookFlag != "") {
+		return fmt.Errorf("--signal-pid and --hook require --watch")
+	}
+	if watchFlag {
+		if (fileFlag == "" && len(args) == 0) || fileFlag == "-" || (len(args) > 0 && args[0] == "-") {
+			return fmt.Errorf("--watch requires an input file")
+		}
+		if (outFlag == "" || outFlag == "-") && toDirFlag == "" {
+			return fmt.Errorf("--watch requires --output or --to-dir")
+		}
+	}
 	return nil
 }
 
@@ -78,11 +127,15 @@ func Run(_ *cobra.Command, args []string) error {
 	outputName := outFlag
 	stdinInUse := false
 
-	var inputName string
+	inputName := fileFlag
 	if len(args) > 0 {
 		inputName = args[0]
 	}
 
+	if watchFlag {
+		return RunWatch(inputName)
+	}
+
 	if inputName != "" && inputName != "-" {
 		f, err := os.Open(inputName)
 		if err != nil {
@@ -94,6 +147,10 @@ func Run(_ *cobra.Command, args []string) error {
 		stdinInUse = true
 	}
 
+	if toDirFlag != "" {
+		return RunToDir(identityFlags, in, stdinInUse, refsDir(inputName, stdinInUse))
+	}
+
 	if outputName != "" && outputName != "-" {
 		if !stdinInUse {
 			_, err := os.Stat(inputName)
@@ -123,29 +180,60 @@ func Run(_ *cobra.Command, args []string) error {
 	}
 
 	if yamlFlag {
-		return DecryptYAML(identityFlags, in, out, stdinInUse, yamlNoTagFlag, yamlDiscardNoTagFlag)
+		return DecryptYAML(identityFlags, in, out, stdinInUse, yamlNoTagFlag, yamlDiscardNoTagFlag, refsDir(inputName, stdinInUse))
 	}
 
 	return Decrypt(identityFlags, in, out, stdinInUse)
 }
 
-func Decrypt(keys []string, in io.Reader, out io.Writer, stdinInUse bool) error {
+// refsDir returns the directory of the files references are resolved from
+// with --resolve-refs, or "" when references are not resolved.
+func refsDir(inputName string, stdinInUse bool) string {
+	switch {
+	case !resolveRefsFlag:
+		return ""
+	case stdinInUse:
+		return "."
+	default:
+		return filepath.Dir(inputName)
+	}
+}
+
+// Identities returns the identities used for decrypting: a lazy scrypt
+// identity, the agent identity if an agent is running, the default OpenSSH
+// keys and the given identity files.
+func Identities(keys []string, stdinInUse bool) ([]age.Identity, error) {
 	identities := []age.Identity{
 		// If there is a scrypt recipient (it will have to be the only one)
 		// this identity will be invoked.
 		&utils.LazyScryptIdentity{utils.PassphrasePrompt},
 	}
 
+	// The agent holds unlocked identities, try it before those which would
+	// prompt for a passphrase.
+	if socket := os.Getenv(utils.AgentSocketEnv); socket != "" {
+		identities = append(identities, &utils.AgentIdentity{Socket: socket})
+	}
+
 	utils.AddOpenSSHIdentities(&identities)
 
 	for _, name := range keys {
 		ids, err := utils.ParseIdentitiesFile(name, stdinInUse)
 		if err != nil {
-			return fmt.Errorf("error reading %q: %w", name, err)
+			return nil, fmt.Errorf("error reading %q: %w", name, err)
 		}
 		identities = append(identities, ids...)
 	}
 
+	return identities, nil
+}
+
+func Decrypt(keys []string, in io.Reader, out io.Writer, stdinInUse bool) error {
+	identities, err := Identities(keys, stdinInUse)
+	if err != nil {
+		return err
+	}
+
 	rr := bufio.NewReader(in)
 	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
 		in = armor.NewReader(rr)
@@ -165,21 +253,19 @@ func Decrypt(keys []string, in io.Reader, out io.Writer, stdinInUse bool) error
 	return nil
 }
 
-func DecryptYAML(keys []string, in io.Reader, out io.Writer, stdinInUse, noTag bool, discardNoTag bool) error {
-	identities := []age.Identity{
-		// If there is a scrypt recipient (it will have to be the only one)
-		// this identity will be invoked.
-		&utils.LazyScryptIdentity{utils.PassphrasePrompt},
+// DecryptYAML decrypts the !crypto/age tagged values of the YAML documents
+// read from in. References to values of the files of refDir are resolved
+// unless it is empty.
+func DecryptYAML(keys []string, in io.Reader, out io.Writer, stdinInUse, noTag bool, discardNoTag bool, refDir string) error {
+	identities, err := Identities(keys, stdinInUse)
+	if err != nil {
+		return err
 	}
 
-	utils.AddOpenSSHIdentities(&identities)
-
-	for _, name := range keys {
-		ids, err := utils.ParseIdentitiesFile(name, stdinInUse)
-		if err != nil {
-			return fmt.Errorf("error reading %q: %v", name, err)
-		}
-		identities = append(identities, ids...)
+	var resolver *Resolver
+	if refDir != "" {
+		resolver = NewResolver(identities)
+		resolver.KeepTags = !noTag
 	}
 
 	node := yaml.Node{}
@@ -202,6 +288,12 @@ func DecryptYAML(keys []string, in io.Reader, out io.Writer, stdinInUse, noTag b
 			return fmt.Errorf("yaml decoding failed: %w", err)
 		}
 
+		if resolver != nil {
+			if err := resolver.Resolve(&node, refDir); err != nil {
+				return fmt.Errorf("failed to resolve references: %w", err)
+			}
+		}
+
 		if err := encoder.Encode(&w); err != nil {
 			return fmt.Errorf("yaml encoding failed: %w", err)
 		}
@@ -213,3 +305,142 @@ func DecryptYAML(keys []string, in io.Reader, out io.Writer, stdinInUse, noTag b
 
 	return nil
 }
+
+// Document is a decrypted YAML document along with the paths of the values
+// which were encrypted and of the ones tagged with utils.BinaryAttribute.
+type Document struct {
+	Node    *yaml.Node
+	Secrets map[string]bool
+	Binary  map[string]bool
+}
+
+// IsSecret reports whether path or one of its ancestors was encrypted.
+func (d *Document) IsSecret(path utils.Path) bool {
+	for i := len(path); i >= 0; i-- {
+		if d.Secrets[path[:i].String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSecret reports whether path, one of its ancestors or one of the values
+// below it was encrypted.
+func (d *Document) HasSecret(path utils.Path) bool {
+	if d.IsSecret(path) {
+		return true
+	}
+	for p := range d.Secrets {
+		if sp, err := utils.ParsePath(p); err == nil && sp.HasPrefix(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecryptDocuments decrypts every YAML document read from in. The tags of the
+// decrypted values are stripped.
+func DecryptDocuments(identities []age.Identity, in io.Reader) ([]Document, error) {
+	var docs []Document
+
+	decoder := yaml.NewDecoder(in)
+	for {
+		raw := yaml.Node{}
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("yaml decoding failed: %w", err)
+		}
+
+		doc, err := DecryptDocument(identities, &raw)
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// hasTagged reports whether node or one of the nodes below it, aliases
+// included, is tagged !crypto/age.
+func hasTagged(node *yaml.Node) bool {
+	seen := map[*yaml.Node]bool{}
+
+	var visit func(*yaml.Node) bool
+	visit = func(n *yaml.Node) bool {
+		if n == nil || seen[n] {
+			return false
+		}
+		seen[n] = true
+
+		if _, ok := utils.ParseAgeTag(n.Tag); ok {
+			return true
+		}
+		if n.Kind == yaml.AliasNode {
+			return visit(n.Alias)
+		}
+		for _, c := range n.Content {
+			if visit(c) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return visit(node)
+}
+
+// DecryptDocument returns a decrypted copy of the YAML node raw.
+func DecryptDocument(identities []age.Identity, raw *yaml.Node) (Document, error) {
+	doc := Document{Node: &yaml.Node{}, Secrets: map[string]bool{}, Binary: map[string]bool{}}
+
+	// Aliases and merge keys are secret when the values they refer to are,
+	// since they are decrypted along with them.
+	err := utils.Walk(raw, func(path utils.Path, n *yaml.Node) error {
+		attrs, ok := utils.ParseAgeTag(n.Tag)
+		if ok || (n.Kind == yaml.AliasNode && hasTagged(n.Alias)) {
+			doc.Secrets[path.String()] = true
+		}
+		if slices.Contains(attrs, utils.BinaryAttribute) {
+			doc.Binary[path.String()] = true
+		}
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Tag == "!!merge" && hasTagged(n.Content[i+1]) {
+					doc.Secrets[path.Child(utils.PathElem{Key: n.Content[i].Value}).String()] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return doc, err
+	}
+
+	w := yage.Wrapper{
+		Value:      doc.Node,
+		Identities: identities,
+		ForceNoTag: true,
+	}
+
+	if err := raw.Decode(&w); err != nil {
+		return doc, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	// Decrypted values are strings whatever they look like, and so are the
+	// values tagged but not encrypted yet.
+	for p := range doc.Secrets {
+		path, err := utils.ParsePath(p)
+		if err != nil {
+			return doc, err
+		}
+		if n, err := utils.Lookup(doc.Node, path); err == nil && n.Kind == yaml.ScalarNode {
+			n.Tag = "!!str"
+			n.Style &^= yaml.TaggedStyle
+		}
+	}
+
+	return doc, nil
+}
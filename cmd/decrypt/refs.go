@@ -0,0 +1,217 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package decrypt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"filippo.io/age"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+// RefTag marks values referencing a value of another file, as in
+// `!crypto/age-ref secrets/db.yaml#.password`.
+const RefTag = "!crypto/age-ref"
+
+// RefScheme prefixes references embedded in strings, as in
+// `postgres://app:ref+yage://secrets/db.yaml#.password@db/app`. Embedded
+// references end at the first character which can't be part of an unquoted
+// path.
+const RefScheme = "ref+yage://"
+
+var refRegexp = regexp.MustCompile(regexp.QuoteMeta(RefScheme) + `[^\s#]+(#[\w.\-\[\]]*)?`)
+
+// Resolver resolves references to values of other files. Referenced files
+// are decrypted once and kept in memory.
+type Resolver struct {
+	// KeepTags tags the resolved values which were encrypted with AgeTag, so
+	// that encrypting the output encrypts them again.
+	KeepTags bool
+
+	identities []age.Identity
+	docs       map[string]*Document
+	stack      []string
+}
+
+func NewResolver(identities []age.Identity) *Resolver {
+	return &Resolver{identities: identities, docs: map[string]*Document{}}
+}
+
+// Resolve replaces the references found in node with the values they point
+// to. File names are relative to dir and can't point outside of it.
+func (r *Resolver) Resolve(node *yaml.Node, dir string) error {
+	return r.resolve(node, dir, dir)
+}
+
+// resolve resolves the references of node, found in a file of dir which is
+// itself below root.
+func (r *Resolver) resolve(node *yaml.Node, root, dir string) error {
+	return utils.Walk(node, func(path utils.Path, n *yaml.Node) error {
+		if n.Kind != yaml.ScalarNode {
+			return nil
+		}
+
+		wrap := func(err error) error {
+			if len(path) == 0 {
+				return err
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if n.Tag == RefTag {
+			target, doc, targetPath, err := r.lookup(root, dir, n.Value)
+			if err != nil {
+				return wrap(err)
+			}
+			if r.KeepTags {
+				target = tagSecrets(doc, targetPath, target)
+			}
+
+			head, line, foot := n.HeadComment, n.LineComment, n.FootComment
+			*n = *target
+			n.HeadComment, n.LineComment, n.FootComment = head, line, foot
+
+			return utils.ErrSkipChildren
+		}
+
+		if !strings.Contains(n.Value, RefScheme) {
+			return nil
+		}
+
+		var err error
+		secret := false
+		n.Value = refRegexp.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			if err != nil {
+				return ref
+			}
+			target, doc, targetPath, lerr := r.lookup(root, dir, strings.TrimPrefix(ref, RefScheme))
+			if lerr != nil {
+				err = lerr
+				return ref
+			}
+			if target.Kind != yaml.ScalarNode {
+				err = fmt.Errorf("%s does not point to a scalar", ref)
+			}
+			secret = secret || doc.IsSecret(targetPath) || target.Tag == utils.AgeTag
+			return target.Value
+		})
+		if err != nil {
+			return wrap(err)
+		}
+		if r.KeepTags && secret {
+			n.Tag = utils.AgeTag
+		}
+
+		return nil
+	})
+}
+
+// lookup returns the node pointed to by ref, written `FILE#PATH`, with its
+// own references resolved, along with its document and path. The file must
+// be below root.
+func (r *Resolver) lookup(root, dir, ref string) (*yaml.Node, *Document, utils.Path, error) {
+	file, p, _ := strings.Cut(ref, "#")
+	if file == "" {
+		return nil, nil, nil, fmt.Errorf("invalid reference %q: missing file name", ref)
+	}
+	if filepath.IsAbs(file) {
+		return nil, nil, nil, fmt.Errorf("invalid reference %q: absolute file name", ref)
+	}
+	file = filepath.Join(dir, file)
+	if rel, err := filepath.Rel(root, file); err != nil || !filepath.IsLocal(rel) {
+		return nil, nil, nil, fmt.Errorf("invalid reference %q: %s is outside of %s", ref, file, root)
+	}
+
+	path, err := utils.ParsePath(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key := file + "#" + path.String()
+	for _, k := range r.stack {
+		if k == key {
+			return nil, nil, nil, fmt.Errorf("reference cycle: %s -> %s", strings.Join(r.stack, " -> "), key)
+		}
+	}
+	r.stack = append(r.stack, key)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	doc, err := r.load(file)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	node, err := utils.Lookup(doc.Node, path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	// Resolving in place makes later lookups of the same values free.
+	if err := r.resolve(node, root, filepath.Dir(file)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return node, doc, path, nil
+}
+
+// tagSecrets returns a copy of node, found at path in doc, in which the
+// values which were encrypted are tagged with AgeTag.
+func tagSecrets(doc *Document, path utils.Path, node *yaml.Node) *yaml.Node {
+	c := *node
+
+	switch c.Kind {
+	case yaml.ScalarNode:
+		if doc.IsSecret(path) {
+			c.Tag = utils.AgeTag
+		}
+	case yaml.MappingNode:
+		c.Content = make([]*yaml.Node, len(node.Content))
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			c.Content[i] = node.Content[i]
+			c.Content[i+1] = tagSecrets(doc, path.Child(utils.PathElem{Key: node.Content[i].Value}), node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		c.Content = make([]*yaml.Node, len(node.Content))
+		for i, n := range node.Content {
+			c.Content[i] = tagSecrets(doc, path.Child(utils.PathElem{Index: i, IsIndex: true}), n)
+		}
+	}
+
+	return &c
+}
+
+// load returns the first document of file, decrypted.
+func (r *Resolver) load(file string) (*Document, error) {
+	if doc, ok := r.docs[file]; ok {
+		return doc, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open referenced file %q: %w", file, err)
+	}
+	defer f.Close()
+
+	docs, err := DecryptDocuments(r.identities, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("%s: no YAML document", file)
+	}
+	doc := &docs[0]
+	r.docs[file] = doc
+
+	return doc, nil
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package decrypt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+// ToDirManifest is the file listing the files written by ToDir so that they
+// can be removed once they are no longer selected.
+const ToDirManifest = ".yage-files"
+
+// RunToDir decrypts the first YAML document read from in and writes the
+// values selected with --path to --to-dir, see ToDir. References are resolved
+// from the files of refDir unless it is empty.
+func RunToDir(keys []string, in io.Reader, stdinInUse bool, refDir string) error {
+	uid, gid, err := ParseOwner(ownerFlag)
+	if err != nil {
+		return err
+	}
+
+	paths := []utils.Path{{}}
+	if len(pathFlags) > 0 {
+		paths = paths[:0]
+		for _, p := range pathFlags {
+			path, err := utils.ParsePath(p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+	}
+
+	identities, err := Identities(keys, stdinInUse)
+	if err != nil {
+		return err
+	}
+
+	docs, err := DecryptDocuments(identities, in)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("no YAML document found")
+	}
+
+	if refDir != "" {
+		if err := NewResolver(identities).Resolve(docs[0].Node, refDir); err != nil {
+			return err
+		}
+	}
+
+	files, err := DirFiles(docs[0].Node, paths)
+	if err != nil {
+		return err
+	}
+
+	return ToDir(toDirFlag, files, uid, gid)
+}
+
+// DirFiles returns the scalars found below paths in node indexed by the name
+// of the file they are written to by ToDir: their path relative to the
+// selected path, elements joined with dots, or the last element of the
+// selected path for scalars selected directly.
+func DirFiles(node *yaml.Node, paths []utils.Path) (map[string]string, error) {
+	files := map[string]string{}
+	origins := map[string]string{}
+
+	for _, path := range paths {
+		n, err := utils.Lookup(node, path)
+		if err != nil {
+			return nil, err
+		}
+
+		err = utils.Walk(n, func(rel utils.Path, v *yaml.Node) error {
+			for v.Kind == yaml.AliasNode && v.Alias != nil {
+				v = v.Alias
+			}
+			if v.Kind != yaml.ScalarNode {
+				return nil
+			}
+
+			full := append(append(utils.Path{}, path...), rel...)
+			if len(rel) == 0 {
+				rel = full[len(full)-1:]
+			}
+			if len(rel) == 0 {
+				return fmt.Errorf("%s: a scalar document can't be written to a directory", full)
+			}
+
+			var parts []string
+			for _, e := range rel {
+				if e.IsIndex {
+					parts = append(parts, strconv.Itoa(e.Index))
+				} else {
+					parts = append(parts, e.Key)
+				}
+			}
+
+			name := strings.Join(parts, ".")
+			if name == "" || name == ToDirManifest || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+				return fmt.Errorf("%s: can't be written to a file named %q", full, name)
+			}
+			if o, ok := origins[name]; ok && o != full.String() {
+				return fmt.Errorf("%s and %s are both written to %s", o, full, name)
+			}
+
+			origins[name] = full.String()
+			files[name] = v.Value
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// ParseOwner parses owner, written `USER[:GROUP]` with names or numeric ids,
+// and returns -1 for what is not given.
+func ParseOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+
+	u, g, hasGroup := strings.Cut(owner, ":")
+
+	if u != "" {
+		id, err := strconv.Atoi(u)
+		if err != nil {
+			usr, err := user.Lookup(u)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid owner %q: %w", owner, err)
+			}
+			if id, err = strconv.Atoi(usr.Uid); err != nil {
+				return 0, 0, fmt.Errorf("invalid owner %q: uid %q is not numeric", owner, usr.Uid)
+			}
+			if !hasGroup {
+				if gid, err = strconv.Atoi(usr.Gid); err != nil {
+					return 0, 0, fmt.Errorf("invalid owner %q: gid %q is not numeric", owner, usr.Gid)
+				}
+			}
+		}
+		uid = id
+	}
+
+	if g != "" {
+		id, err := strconv.Atoi(g)
+		if err != nil {
+			grp, err := user.LookupGroup(g)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid owner %q: %w", owner, err)
+			}
+			if id, err = strconv.Atoi(grp.Gid); err != nil {
+				return 0, 0, fmt.Errorf("invalid owner %q: gid %q is not numeric", owner, grp.Gid)
+			}
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
+
+// ToDir writes each of files to its own file of dir, read-only for its owner
+// and owned by uid and gid unless they are -1. All files are written to
+// temporary files before any of them is renamed, so that no file is ever
+// partially written and a failed write leaves the previous files in place.
+// The renames are not atomic as a whole: a reader may see new and previous
+// files side by side while they happen. Files written by a previous run and
+// not part of files are removed. ToDir refuses to write into a world-writable
+// directory, or through a symbolic link.
+func ToDir(dir string, files map[string]string, uid, gid int) error {
+	// A trailing slash would make Lstat follow a symbolic link.
+	dir = filepath.Clean(dir)
+
+	info, err := os.Lstat(dir)
+	switch {
+	case err != nil:
+		return err
+	case info.Mode()&fs.ModeSymlink != 0:
+		return fmt.Errorf("%s is a symbolic link", dir)
+	case !info.IsDir():
+		return fmt.Errorf("%s is not a directory", dir)
+	case info.Mode().Perm()&0o002 != 0:
+		return fmt.Errorf("%s is world-writable", dir)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range append([]string{ToDirManifest}, names...) {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", filepath.Join(dir, name))
+		}
+	}
+
+	previous, err := readManifest(filepath.Join(dir, ToDirManifest))
+	if err != nil {
+		return err
+	}
+
+	temps := map[string]string{}
+	defer func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}()
+
+	for name, value := range files {
+		t, err := writeTemp(dir, name, value, uid, gid)
+		if t != "" {
+			temps[name] = t
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The union of the previous and new files is listed while the files are
+	// renamed, so that a failed rename leaves none of them unlisted.
+	union := append(append([]string{}, previous...), names...)
+	sort.Strings(union)
+	union = slices.Compact(union)
+
+	if err := writeFile(dir, ToDirManifest, strings.Join(union, "\n")+"\n", uid, gid); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := os.Rename(temps[name], filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		delete(temps, name)
+	}
+
+	if err := writeFile(dir, ToDirManifest, strings.Join(names, "\n")+"\n", uid, gid); err != nil {
+		return err
+	}
+
+	for _, name := range previous {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile writes value to the file name of dir through a temporary file.
+func writeFile(dir, name, value string, uid, gid int) error {
+	t, err := writeTemp(dir, name, value, uid, gid)
+	if err != nil {
+		if t != "" {
+			os.Remove(t)
+		}
+		return err
+	}
+	if err := os.Rename(t, filepath.Join(dir, name)); err != nil {
+		os.Remove(t)
+		return err
+	}
+	return nil
+}
+
+func writeTemp(dir, name, value string, uid, gid int) (string, error) {
+	f, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := f.Chmod(0o400); err != nil {
+		return f.Name(), err
+	}
+	if uid != -1 || gid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			return f.Name(), err
+		}
+	}
+	if _, err := io.WriteString(f, value); err != nil {
+		return f.Name(), err
+	}
+	if err := f.Sync(); err != nil {
+		return f.Name(), err
+	}
+
+	return f.Name(), f.Close()
+}
+
+// readManifest returns the valid file names listed in the manifest name.
+func readManifest(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n := scanner.Text()
+		if n != "" && n != ToDirManifest && !strings.HasPrefix(n, ".") && !strings.ContainsAny(n, "/\\\x00") {
+			names = append(names, n)
+		}
+	}
+
+	return names, scanner.Err()
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package decrypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+const (
+	// WatchDelay is the time waited after a change before decrypting again,
+	// so that files written in several steps are read once complete.
+	WatchDelay = 100 * time.Millisecond
+	// WatchMinBackoff is the time waited before decrypting again after a
+	// failure, doubled after each new failure up to WatchMaxBackoff.
+	WatchMinBackoff = time.Second
+	WatchMaxBackoff = time.Minute
+)
+
+// RunWatch decrypts inputName to --output or --to-dir, then again each time
+// the input or identity files, default SSH keys included, change, until
+// interrupted. After decrypting again, the process --signal-pid is signalled
+// and --hook is run.
+func RunWatch(inputName string) error {
+	var sig os.Signal
+	if signalPIDFlag > 0 {
+		var err error
+		if sig, err = utils.ParseSignal(signalFlag); err != nil {
+			return err
+		}
+	}
+
+	run := func() error {
+		f, err := os.Open(inputName)
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", inputName, err)
+		}
+		defer f.Close()
+
+		refDir := refsDir(inputName, false)
+		if toDirFlag != "" {
+			return RunToDir(identityFlags, f, false, refDir)
+		}
+
+		buf := &bytes.Buffer{}
+		if yamlFlag {
+			err = DecryptYAML(identityFlags, f, buf, false, yamlNoTagFlag, yamlDiscardNoTagFlag, refDir)
+		} else {
+			err = Decrypt(identityFlags, f, buf, false)
+		}
+		if err != nil {
+			return err
+		}
+
+		return utils.WriteFileAtomic(outFlag, buf.Bytes(), 0o600)
+	}
+
+	notify := func() error {
+		if sig != nil {
+			p, err := os.FindProcess(signalPIDFlag)
+			if err != nil {
+				return err
+			}
+			if err := p.Signal(sig); err != nil {
+				return fmt.Errorf("failed to signal process %d: %w", signalPIDFlag, err)
+			}
+		}
+		if hookFlag != "" {
+			if err := Hook(hookFlag); err != nil {
+				return fmt.Errorf("hook failed: %w", err)
+			}
+		}
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), utils.StopSignals...)
+	defer stop()
+
+	files := append([]string{inputName}, identityFlags...)
+	files = append(files, utils.OpenSSHIdentityFiles()...)
+
+	return Watch(ctx, files, run, notify)
+}
+
+// Watch calls run, then calls it again when one of files changes, until ctx
+// is done. Failed runs are retried with an exponential backoff. notify is
+// called after each successful run but the first one.
+func Watch(ctx context.Context, files []string, run func() error, notify func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watched, err := addWatches(watcher, files)
+	if err != nil {
+		return err
+	}
+
+	var backoff time.Duration
+	var retryAt time.Time
+	attempted := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !watched[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			// Symlinks may point to other directories now.
+			if watched, err = addWatches(watcher, files); err != nil {
+				return err
+			}
+			timer.Reset(max(WatchDelay, time.Until(retryAt)))
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("yage: watch: %v", err)
+
+		case <-timer.C:
+			err := run()
+			notifying := attempted
+			attempted = true
+
+			if err != nil {
+				backoff = min(max(2*backoff, WatchMinBackoff), WatchMaxBackoff)
+				retryAt = time.Now().Add(backoff)
+				timer.Reset(backoff)
+				log.Printf("yage: %v, retrying in %s", err, backoff)
+				continue
+			}
+			backoff, retryAt = 0, time.Time{}
+
+			if notifying && notify != nil {
+				if err := notify(); err != nil {
+					log.Printf("yage: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// KubernetesDataDir is the symlink Kubernetes swaps to update the files of
+// Secret and ConfigMap volumes, which are symlinks to files below it.
+const KubernetesDataDir = "..data"
+
+// addWatches watches the directories of files and of the files they link to,
+// and returns the names of the entries whose changes are changes of files.
+// Directories are watched rather than files so that files replaced by
+// renames, as editors, git and Kubernetes do, are still watched. Missing
+// directories are not watched.
+func addWatches(watcher *fsnotify.Watcher, files []string) (map[string]bool, error) {
+	watched := map[string]bool{}
+	dirs := map[string]bool{}
+
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+
+		names := []string{abs, filepath.Join(filepath.Dir(abs), KubernetesDataDir)}
+		if target, err := filepath.EvalSymlinks(abs); err == nil && target != abs {
+			names = append(names, target)
+		}
+
+		for _, name := range names {
+			watched[name] = true
+
+			dir := filepath.Dir(name)
+			if dirs[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to watch %q: %w", dir, err)
+			}
+			dirs[dir] = true
+		}
+	}
+
+	return watched, nil
+}
+
+// Hook runs command with the shell.
+func Hook(command string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
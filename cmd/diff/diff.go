@@ -0,0 +1,265 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package diff
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	redactedFlag  bool
+	exitCodeFlag  bool
+	identityFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var DiffCmd = cobra.Command{
+	Use:          "diff OLD NEW",
+	Short:        "Show the decrypted differences between two YAML files",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	DiffCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	DiffCmd.PersistentFlags().BoolVar(&redactedFlag, "redacted", false, "Do not show encrypted values, only whether they changed")
+	DiffCmd.PersistentFlags().BoolVar(&exitCodeFlag, "exit-code", false, "Exit with 1 if there were differences")
+
+	if err := cobra.MarkFlagFilename(DiffCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+// Change is a difference between two YAML documents.
+type Change struct {
+	Path   string
+	Kind   byte // '+', '-' or '~'
+	Old    *yaml.Node
+	New    *yaml.Node
+	Secret bool
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	if args[0] == "-" && args[1] == "-" {
+		return fmt.Errorf("standard input is used for multiple purposes")
+	}
+
+	identities, err := decrypt.Identities(identityFlags, args[0] == "-" || args[1] == "-")
+	if err != nil {
+		return err
+	}
+
+	var docs [2][]decrypt.Document
+	for i, name := range args {
+		var in io.Reader = os.Stdin
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return fmt.Errorf("failed to open input file %q: %w", name, err)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		if docs[i], err = decrypt.DecryptDocuments(identities, in); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	changes := Diff(docs[0], docs[1])
+	if len(changes) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stdout, "--- %s\n+++ %s\n", args[0], args[1])
+	if err := WriteChanges(os.Stdout, changes, redactedFlag); err != nil {
+		return err
+	}
+
+	if exitCodeFlag {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// Diff returns the structural differences between two sets of decrypted
+// YAML documents.
+func Diff(old, new []decrypt.Document) []Change {
+	var changes []Change
+
+	for i := 0; i < len(old) || i < len(new); i++ {
+		var a, b *decrypt.Document
+		var an, bn *yaml.Node
+		if i < len(old) {
+			a, an = &old[i], old[i].Node
+		}
+		if i < len(new) {
+			b, bn = &new[i], new[i].Node
+		}
+
+		prefix := ""
+		if len(old) > 1 || len(new) > 1 {
+			prefix = "#" + strconv.Itoa(i)
+		}
+
+		diffNodes(nil, an, bn, func(path utils.Path, kind byte, o, n *yaml.Node) {
+			// Changes of collections holding secrets render the secrets.
+			secret := (a != nil && a.HasSecret(path)) || (b != nil && b.HasSecret(path))
+			changes = append(changes, Change{Path: prefix + path.String(), Kind: kind, Old: o, New: n, Secret: secret})
+		})
+	}
+
+	return changes
+}
+
+type emitFunc func(path utils.Path, kind byte, old, new *yaml.Node)
+
+func diffNodes(path utils.Path, a, b *yaml.Node, emit emitFunc) {
+	a, b = resolve(a), resolve(b)
+
+	switch {
+	case a == nil && b == nil:
+		return
+	case a == nil:
+		leaves(path, b, func(p utils.Path, n *yaml.Node) { emit(p, '+', nil, n) })
+		return
+	case b == nil:
+		leaves(path, a, func(p utils.Path, n *yaml.Node) { emit(p, '-', n, nil) })
+		return
+	}
+
+	switch {
+	case a.Kind == yaml.MappingNode && b.Kind == yaml.MappingNode:
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(a.Content); i += 2 {
+			key := a.Content[i].Value
+			seen[key] = true
+			_, bv := utils.MappingEntry(b, key)
+			diffNodes(path.Child(utils.PathElem{Key: key}), a.Content[i+1], bv, emit)
+		}
+		for i := 0; i+1 < len(b.Content); i += 2 {
+			if key := b.Content[i].Value; !seen[key] {
+				diffNodes(path.Child(utils.PathElem{Key: key}), nil, b.Content[i+1], emit)
+			}
+		}
+	case a.Kind == yaml.SequenceNode && b.Kind == yaml.SequenceNode:
+		for i := 0; i < len(a.Content) || i < len(b.Content); i++ {
+			var an, bn *yaml.Node
+			if i < len(a.Content) {
+				an = a.Content[i]
+			}
+			if i < len(b.Content) {
+				bn = b.Content[i]
+			}
+			diffNodes(path.Child(utils.PathElem{Index: i, IsIndex: true}), an, bn, emit)
+		}
+	case a.Kind == yaml.ScalarNode && b.Kind == yaml.ScalarNode:
+		if a.Value != b.Value || a.ShortTag() != b.ShortTag() {
+			emit(path, '~', a, b)
+		}
+	default:
+		emit(path, '~', a, b)
+	}
+}
+
+// leaves calls fn for every scalar and empty collection of node.
+func leaves(path utils.Path, node *yaml.Node, fn func(utils.Path, *yaml.Node)) {
+	node = resolve(node)
+
+	switch {
+	case node.Kind == yaml.MappingNode && len(node.Content) > 0:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			leaves(path.Child(utils.PathElem{Key: node.Content[i].Value}), node.Content[i+1], fn)
+		}
+	case node.Kind == yaml.SequenceNode && len(node.Content) > 0:
+		for i, c := range node.Content {
+			leaves(path.Child(utils.PathElem{Index: i, IsIndex: true}), c, fn)
+		}
+	default:
+		fn(path, node)
+	}
+}
+
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// WriteChanges writes changes one per line. Encrypted values are only
+// described when redacted is set.
+func WriteChanges(out io.Writer, changes []Change, redacted bool) error {
+	for _, c := range changes {
+		var err error
+		switch {
+		case redacted && c.Secret:
+			desc := map[byte]string{'+': "added", '-': "removed", '~': "changed"}[c.Kind]
+			_, err = fmt.Fprintf(out, "%c %s: %s (secret)\n", c.Kind, c.Path, desc)
+		case c.Kind == '+':
+			_, err = fmt.Fprintf(out, "+ %s: %s\n", c.Path, Render(c.New))
+		case c.Kind == '-':
+			_, err = fmt.Fprintf(out, "- %s: %s\n", c.Path, Render(c.Old))
+		default:
+			_, err = fmt.Fprintf(out, "~ %s: %s -> %s\n", c.Path, Render(c.Old), Render(c.New))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Render renders node on a single line.
+func Render(node *yaml.Node) string {
+	if node.Kind == yaml.ScalarNode {
+		if node.ShortTag() == "!!str" {
+			return strconv.Quote(node.Value)
+		}
+		return node.Value
+	}
+
+	b, err := yaml.Marshal(flow(node))
+	if err != nil {
+		return "?"
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+func flow(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.Style |= yaml.FlowStyle
+	c.HeadComment, c.LineComment, c.FootComment = "", "", ""
+	c.Content = nil
+	for _, n := range node.Content {
+		c.Content = append(c.Content, flow(n))
+	}
+	return &c
+}
@@ -193,6 +193,21 @@ func passphrasePromptForEncryption() (string, error) {
 }
 
 func EncryptKeys(keys, files, identities []string, in io.Reader, out io.Writer, armor bool, stdinInUse, yaml bool) error {
+	recipients, err := Recipients(keys, files, identities, stdinInUse)
+	if err != nil {
+		return err
+	}
+
+	if yaml {
+		return EncryptYAML(recipients, in, out)
+	}
+
+	return Encrypt(recipients, in, out, armor)
+}
+
+// Recipients returns the recipients given as public keys, recipient files and
+// identity files.
+func Recipients(keys, files, identities []string, stdinInUse bool) ([]age.Recipient, error) {
 	var recipients []age.Recipient
 
 	for _, key := range keys {
@@ -203,7 +218,7 @@ func EncryptKeys(keys, files, identities []string, in io.Reader, out io.Writer,
 				"    yage -R "+err.Username()+".keys")
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		recipients = append(recipients, r)
@@ -212,7 +227,7 @@ func EncryptKeys(keys, files, identities []string, in io.Reader, out io.Writer,
 	for _, name := range files {
 		recs, err := utils.ParseRecipientsFile(name, stdinInUse)
 		if err != nil {
-			return fmt.Errorf("failed to parse recipient file %q: %w", name, err)
+			return nil, fmt.Errorf("failed to parse recipient file %q: %w", name, err)
 		}
 
 		recipients = append(recipients, recs...)
@@ -221,7 +236,7 @@ func EncryptKeys(keys, files, identities []string, in io.Reader, out io.Writer,
 	for _, name := range identities {
 		ids, err := utils.ParseIdentitiesFile(name, stdinInUse)
 		if err != nil {
-			return fmt.Errorf("failed to read %q: %w", name, err)
+			return nil, fmt.Errorf("failed to read %q: %w", name, err)
 		}
 
 		r, err := utils.IdentitiesToRecipients(ids)
@@ -232,11 +247,7 @@ func EncryptKeys(keys, files, identities []string, in io.Reader, out io.Writer,
 		recipients = append(recipients, r...)
 	}
 
-	if yaml {
-		return EncryptYAML(recipients, in, out)
-	}
-
-	return Encrypt(recipients, in, out, armor)
+	return recipients, nil
 }
 
 func EncryptPass(pass string, in io.Reader, out io.Writer, armor bool, yaml bool) error {
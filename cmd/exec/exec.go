@@ -0,0 +1,304 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package exec
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	fileFlags     []string
+	identityFlags []string
+	pathFlags     []string
+	envFlags      []string
+	prefixFlag    string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var ExecCmd = cobra.Command{
+	Use:          "exec -f FILE [flags] -- COMMAND [ARG...]",
+	Short:        "Run a command with decrypted values as environment variables",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.MinimumNArgs(1),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	ExecCmd.Flags().SetInterspersed(false)
+	ExecCmd.PersistentFlags().StringArrayVarP(&fileFlags, "file", "f", []string{}, "YAML file to read values from")
+	ExecCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	ExecCmd.PersistentFlags().StringArrayVar(&pathFlags, "path", []string{}, "Path of the values to export (default \".\" unless --env is used)")
+	ExecCmd.PersistentFlags().StringVar(&prefixFlag, "prefix", "", "Prefix of the names of the exported variables")
+	ExecCmd.PersistentFlags().StringArrayVar(&envFlags, "env", []string{}, "Export the value found at `NAME=PATH` as NAME")
+
+	if err := ExecCmd.MarkPersistentFlagRequired("file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(ExecCmd.PersistentFlags(), "file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(ExecCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	var paths []utils.Path
+	for _, p := range pathFlags {
+		path, err := utils.ParsePath(p)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 && len(envFlags) == 0 {
+		paths = append(paths, utils.Path{})
+	}
+
+	identities, err := decrypt.Identities(identityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	var nodes []*yaml.Node
+	for _, name := range fileFlags {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", name, err)
+		}
+		docs, err := decrypt.DecryptDocuments(identities, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(docs) > 0 {
+			nodes = append(nodes, docs[0].Node)
+		}
+	}
+
+	env := map[string]string{}
+	for _, node := range nodes {
+		if err := Environ(env, node, paths, prefixFlag); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range envFlags {
+		name, p, ok := strings.Cut(e, "=")
+		if !ok || !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid --env %q, expected NAME=PATH", e)
+		}
+		path, err := utils.ParsePath(p)
+		if err != nil {
+			return err
+		}
+		value, err := lookupScalar(nodes, path)
+		if err != nil {
+			return err
+		}
+		env[name] = value
+	}
+
+	os.Exit(Exec(args, env))
+
+	return nil
+}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvName returns the environment variable name of the value found at path
+// relative to an exported path: its elements joined with underscores,
+// upper-cased and stripped of characters not allowed in variable names.
+func EnvName(prefix string, path utils.Path) string {
+	var parts []string
+	for _, e := range path {
+		if e.IsIndex {
+			parts = append(parts, strconv.Itoa(e.Index))
+		} else {
+			parts = append(parts, e.Key)
+		}
+	}
+
+	name := strings.ToUpper(strings.Join(parts, "_"))
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if name == "" {
+		return strings.TrimSuffix(prefix, "_")
+	}
+
+	return prefix + name
+}
+
+// Environ adds to env the scalars found below paths in node, named with
+// EnvName.
+func Environ(env map[string]string, node *yaml.Node, paths []utils.Path, prefix string) error {
+	origins := map[string]string{}
+
+	for _, path := range paths {
+		n, err := utils.Lookup(node, path)
+		if err != nil {
+			return err
+		}
+
+		err = flatten(nil, n, func(rel utils.Path, value string) error {
+			name := EnvName(prefix, rel)
+			full := append(append(utils.Path{}, path...), rel...).String()
+			if !envNameRegexp.MatchString(name) {
+				return fmt.Errorf("%s: can't be named %q, use --prefix or --env", full, name)
+			}
+			if o, ok := origins[name]; ok && o != full {
+				return fmt.Errorf("%s and %s are both named %s", o, full, name)
+			}
+			origins[name] = full
+			env[name] = value
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func flatten(path utils.Path, node *yaml.Node, fn func(utils.Path, string) error) error {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Tag == "!!merge" {
+				continue
+			}
+			if err := flatten(path.Child(utils.PathElem{Key: node.Content[i].Value}), node.Content[i+1], fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range node.Content {
+			if err := flatten(path.Child(utils.PathElem{Index: i, IsIndex: true}), c, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value := node.Value
+		if node.ShortTag() == "!!null" {
+			value = ""
+		}
+		return fn(path, value)
+	}
+
+	return nil
+}
+
+func lookupScalar(nodes []*yaml.Node, path utils.Path) (string, error) {
+	for _, node := range nodes {
+		n, err := utils.Lookup(node, path)
+		if errors.Is(err, utils.ErrPathNotFound) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if n.Kind != yaml.ScalarNode {
+			return "", fmt.Errorf("%s: not a scalar", path)
+		}
+		return n.Value, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", utils.ErrPathNotFound, path)
+}
+
+// Exec runs args with env added to the current environment, forwards it the
+// signals yage receives, and returns its exit code.
+func Exec(args []string, env map[string]string) int {
+	environ := os.Environ()
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		environ = append(environ, name+"="+env[name])
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = environ
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return RunCommand(cmd, nil)
+}
+
+// RunCommand starts cmd, calls started if not nil once it is, forwards it
+// the signals yage receives, and returns its exit code.
+func RunCommand(cmd *exec.Cmd, started func()) int {
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("yage: %v", err)
+		return 127
+	}
+	if started != nil {
+		started()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	close(done)
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		log.Printf("yage: %v", err)
+		return 1
+	}
+
+	return exitCode(cmd.ProcessState)
+}
@@ -0,0 +1,20 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !unix
+
+package exec
+
+import (
+	"os"
+)
+
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+func exitCode(state *os.ProcessState) int {
+	return state.ExitCode()
+}
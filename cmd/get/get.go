@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package get
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+	yage "sylr.dev/yaml/age/v3"
+)
+
+var (
+	jsonFlag      bool
+	identityFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var GetCmd = cobra.Command{
+	Use:          "get FILE PATH",
+	Short:        "Print a single decrypted value of a YAML file",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	GetCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	GetCmd.PersistentFlags().BoolVar(&jsonFlag, "json", false, "Output value as JSON")
+
+	if err := cobra.MarkFlagFilename(GetCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	var in io.Reader = os.Stdin
+	inputName := args[0]
+	stdinInUse := false
+
+	if inputName != "-" {
+		f, err := os.Open(inputName)
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", inputName, err)
+		}
+		defer f.Close()
+		in = f
+	} else {
+		stdinInUse = true
+	}
+
+	path, err := utils.ParsePath(args[1])
+	if err != nil {
+		return err
+	}
+
+	return Get(identityFlags, in, os.Stdout, path, stdinInUse, jsonFlag)
+}
+
+// Get decrypts the node found at path in the first YAML document read from in
+// and writes it to out. Scalars are written raw, other nodes as YAML, unless
+// asJSON is set.
+func Get(keys []string, in io.Reader, out io.Writer, path utils.Path, stdinInUse, asJSON bool) error {
+	doc := yaml.Node{}
+	if err := yaml.NewDecoder(in).Decode(&doc); err == io.EOF {
+		return fmt.Errorf("%w: %s", utils.ErrPathNotFound, path)
+	} else if err != nil {
+		return fmt.Errorf("yaml decoding failed: %w", err)
+	}
+
+	node, err := utils.Lookup(&doc, path)
+	if err != nil {
+		return err
+	}
+
+	value, err := DecryptNode(keys, node, stdinInUse)
+	if err != nil {
+		return err
+	}
+
+	return WriteNode(out, value, asJSON)
+}
+
+// DecryptNode decrypts every !crypto/age value found in node and below, and
+// leaves the rest of the document untouched.
+func DecryptNode(keys []string, node *yaml.Node, stdinInUse bool) (*yaml.Node, error) {
+	identities, err := decrypt.Identities(keys, stdinInUse)
+	if err != nil {
+		return nil, err
+	}
+
+	value := yaml.Node{}
+	w := yage.Wrapper{
+		Value:      &value,
+		Identities: identities,
+		ForceNoTag: true,
+	}
+
+	if err := node.Decode(&w); err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return &value, nil
+}
+
+// WriteNode writes node to out, as raw text if it is a scalar, as YAML
+// otherwise, or as JSON if asJSON is set.
+func WriteNode(out io.Writer, node *yaml.Node, asJSON bool) error {
+	if asJSON {
+		var v interface{}
+		if err := node.Decode(&v); err != nil {
+			return fmt.Errorf("yaml decoding failed: %w", err)
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("json encoding failed: %w", err)
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+	}
+
+	if node.Kind == yaml.ScalarNode {
+		value := node.Value
+		if !strings.HasSuffix(value, "\n") {
+			value += "\n"
+		}
+		_, err := io.WriteString(out, value)
+		return err
+	}
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+
+	if err := encoder.Encode(node); err != nil {
+		return fmt.Errorf("yaml encoding failed: %w", err)
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("yaml encoding close failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var GitCmd = cobra.Command{
+	Use:          "git",
+	Short:        "Git integration helpers",
+	GroupID:      "age",
+	SilenceUsage: true,
+}
+
+func init() {
+	GitCmd.AddCommand(&TextconvCmd)
+	GitCmd.AddCommand(&MergeDriverCmd)
+	GitCmd.AddCommand(&InstallCmd)
+}
+
+// Git runs git with args and returns its standard output.
+func Git(args ...string) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
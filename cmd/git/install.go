@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package git
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	installGlobalFlag    bool
+	installMergeFlag     bool
+	installRedactedFlag  bool
+	installIdentityFlags []string
+	installRecipientFile []string
+
+	//go:embed install_examples.txt
+	installExamples string
+)
+
+var InstallCmd = cobra.Command{
+	Use:          "install [PATTERN...]",
+	Short:        "Configure git to diff yage files through yage",
+	SilenceUsage: true,
+	RunE:         RunInstall,
+	Example:      installExamples,
+}
+
+func init() {
+	InstallCmd.PersistentFlags().StringArrayVarP(&installIdentityFlags, "identity", "i", []string{}, "Identity private key git should decrypt with")
+	InstallCmd.PersistentFlags().StringArrayVarP(&installRecipientFile, "recipient-file", "R", []string{}, "Public key file the merge driver should encrypt values taken from theirs to")
+	InstallCmd.PersistentFlags().BoolVar(&installRedactedFlag, "redacted", false, "Configure git to only show redacted content")
+	InstallCmd.PersistentFlags().BoolVar(&installMergeFlag, "merge", false, "Also configure git to merge yage files through yage")
+	InstallCmd.PersistentFlags().BoolVar(&installGlobalFlag, "global", false, "Write the git configuration to the global configuration file")
+
+	for _, f := range []string{"identity", "recipient-file"} {
+		if err := cobra.MarkFlagFilename(InstallCmd.PersistentFlags(), f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func RunInstall(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	var identities []string
+	for _, id := range installIdentityFlags {
+		abs, err := filepath.Abs(id)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, "-i", shellQuote(abs))
+	}
+
+	textconv := []string{"yage", "git", "textconv"}
+	if installRedactedFlag {
+		textconv = append(textconv, "--redacted")
+	}
+	textconv = append(textconv, identities...)
+
+	scope := "--local"
+	if installGlobalFlag {
+		scope = "--global"
+	}
+
+	config := [][2]string{
+		{"diff.yage.textconv", strings.Join(textconv, " ")},
+		// Never store decrypted content in git notes.
+		{"diff.yage.cachetextconv", "false"},
+	}
+	if installMergeFlag {
+		driver := append([]string{"yage", "git", "merge-driver"}, identities...)
+		for _, r := range installRecipientFile {
+			abs, err := filepath.Abs(r)
+			if err != nil {
+				return err
+			}
+			driver = append(driver, "-R", shellQuote(abs))
+		}
+		driver = append(driver, "%O", "%A", "%B", "%P")
+		config = append(config,
+			[2]string{"merge.yage.name", "yage structural merge"},
+			[2]string{"merge.yage.driver", strings.Join(driver, " ")},
+		)
+	}
+
+	for _, kv := range config {
+		if _, err := Git("config", scope, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	top, err := Git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, pattern := range args {
+		if installMergeFlag {
+			lines = append(lines, pattern+" diff=yage merge=yage")
+		} else {
+			lines = append(lines, pattern+" diff=yage")
+		}
+	}
+
+	return AddGitAttributes(filepath.Join(strings.TrimSpace(string(top)), ".gitattributes"), lines)
+}
+
+// AddGitAttributes appends the lines missing from the gitattributes file.
+func AddGitAttributes(name string, lines []string) error {
+	content, err := os.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %q: %w", name, err)
+	}
+
+	existing := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		existing[strings.Join(strings.Fields(line), " ")] = true
+	}
+
+	out := content
+	for _, line := range lines {
+		if existing[line] {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		out = append(out, line+"\n"...)
+		existing[line] = true
+	}
+
+	if len(out) == len(content) {
+		return nil
+	}
+
+	return utils.WriteFileAtomic(name, out, 0o644)
+}
+
+func shellQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,373 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package git
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/cmd/set"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	mergeIdentityFlags      []string
+	mergeRecipientFlags     []string
+	mergeRecipientFileFlags []string
+
+	//go:embed merge_examples.txt
+	mergeExamples string
+)
+
+var MergeDriverCmd = cobra.Command{
+	Use:          "merge-driver BASE OURS THEIRS [PATH]",
+	Short:        "Merge YAML files with encrypted values for git",
+	SilenceUsage: true,
+	Args:         cobra.RangeArgs(3, 4),
+	RunE:         RunMergeDriver,
+	Example:      mergeExamples,
+}
+
+func init() {
+	MergeDriverCmd.PersistentFlags().StringArrayVarP(&mergeIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	MergeDriverCmd.PersistentFlags().StringArrayVarP(&mergeRecipientFlags, "recipient", "r", []string{}, "Encrypt the values taken from theirs again to these recipients")
+	MergeDriverCmd.PersistentFlags().StringArrayVarP(&mergeRecipientFileFlags, "recipient-file", "R", []string{}, "Encrypt the values taken from theirs again to the recipients of this public key file")
+
+	if err := cobra.MarkFlagFilename(MergeDriverCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(MergeDriverCmd.PersistentFlags(), "recipient-file"); err != nil {
+		panic(err)
+	}
+}
+
+// ErrMergeFallback is returned by Merge when the files can't be merged
+// structurally.
+var ErrMergeFallback = errors.New("structural merge not possible")
+
+func RunMergeDriver(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	baseName, oursName, theirsName := args[0], args[1], args[2]
+	name := oursName
+	if len(args) > 3 {
+		name = args[3]
+	}
+
+	var files [3][]byte
+	for i, n := range args[:3] {
+		content, err := os.ReadFile(n)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", n, err)
+		}
+		files[i] = content
+	}
+
+	identities, err := decrypt.Identities(mergeIdentityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	var recipients []age.Recipient
+	if len(mergeRecipientFlags)+len(mergeRecipientFileFlags) > 0 {
+		if recipients, err = encrypt.Recipients(mergeRecipientFlags, mergeRecipientFileFlags, nil, false); err != nil {
+			return err
+		}
+	}
+
+	out, conflicts, err := Merge(identities, recipients, files[0], files[1], files[2])
+	if errors.Is(err, ErrMergeFallback) {
+		log.Printf("yage: %s: %v, falling back to a textual merge", name, err)
+		n, err := MergeFile(baseName, oursName, theirsName)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			os.Exit(1)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := utils.WriteFileAtomic(oursName, out, 0o644); err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		for _, c := range conflicts {
+			log.Printf("yage: %s: conflict at %s", name, c)
+		}
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// Merge merges the YAML files base, ours and theirs by comparing their
+// decrypted values. The result is ours with the values changed in theirs
+// only copied over, and conflict markers around values changed differently on
+// both sides. Encrypted values taken from theirs are copied as they are, or
+// encrypted again to recipients if not nil.
+func Merge(identities []age.Identity, recipients []age.Recipient, base, ours, theirs []byte) ([]byte, []utils.Path, error) {
+	var docs [3]decrypt.Document
+	for i, content := range [][]byte{base, ours, theirs} {
+		d, err := decrypt.DecryptDocuments(identities, bytes.NewReader(content))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMergeFallback, err)
+		}
+		switch len(d) {
+		case 0:
+			docs[i] = decrypt.Document{Secrets: map[string]bool{}}
+		case 1:
+			docs[i] = d[0]
+		default:
+			return nil, nil, fmt.Errorf("%w: multiple documents", ErrMergeFallback)
+		}
+	}
+
+	var takes, deletes, conflicts []utils.Path
+	mergeNodes(nil, root(docs[0].Node), root(docs[1].Node), root(docs[2].Node), func(path utils.Path, theirs *yaml.Node, conflict bool) {
+		switch {
+		case conflict:
+			conflicts = append(conflicts, path)
+		case theirs == nil:
+			deletes = append(deletes, path)
+		default:
+			takes = append(takes, path)
+		}
+	})
+
+	for _, paths := range [][]utils.Path{takes, deletes, conflicts} {
+		for _, p := range paths {
+			if len(p) == 0 {
+				return nil, nil, fmt.Errorf("%w: conflict at the root of the document", ErrMergeFallback)
+			}
+		}
+	}
+
+	var theirsEncrypted map[string]bool
+	if recipients != nil {
+		theirsEncrypted = encryptedPaths(theirs)
+	}
+
+	out := ours
+	var err error
+
+	// Deletions come last so that emptied mappings are not turned into flow
+	// style mappings before entries are added to them.
+	for _, p := range takes {
+		if out, err = utils.CopyYAMLEntry(out, theirs, p); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMergeFallback, err)
+		}
+
+		if recipients == nil {
+			continue
+		}
+		for _, secret := range secretsUnder(&docs[2], p) {
+			// Values tagged but not encrypted yet are left as they are.
+			if !theirsEncrypted[secret.String()] {
+				continue
+			}
+
+			node, err := utils.Lookup(docs[2].Node, secret)
+			if err != nil {
+				return nil, nil, err
+			}
+			if out, err = set.Set(recipients, out, secret, node.Value, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, p := range deletes {
+		if out, err = utils.DeleteYAMLValue(out, p); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMergeFallback, err)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		if out, err = utils.ConflictYAMLEntries(out, theirs, conflicts, "ours", "theirs"); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMergeFallback, err)
+		}
+	}
+
+	return out, conflicts, nil
+}
+
+type mergeFunc func(path utils.Path, theirs *yaml.Node, conflict bool)
+
+func mergeNodes(path utils.Path, base, ours, theirs *yaml.Node, fn mergeFunc) {
+	base, ours, theirs = resolve(base), resolve(ours), resolve(theirs)
+
+	switch {
+	case equal(ours, theirs), equal(base, theirs):
+		return
+	case equal(base, ours):
+		fn(path, theirs, false)
+		return
+	}
+
+	if ours == nil || theirs == nil || ours.Kind != yaml.MappingNode || theirs.Kind != yaml.MappingNode {
+		fn(path, theirs, true)
+		return
+	}
+
+	if base != nil && base.Kind != yaml.MappingNode {
+		base = nil
+	}
+
+	child := func(m *yaml.Node, key string) *yaml.Node {
+		if m == nil {
+			return nil
+		}
+		_, v := utils.MappingEntry(m, key)
+		return v
+	}
+
+	seen := map[string]bool{}
+	for _, m := range []*yaml.Node{ours, theirs, base} {
+		if m == nil {
+			continue
+		}
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			key := m.Content[i].Value
+			if seen[key] || m.Content[i].Tag == "!!merge" {
+				continue
+			}
+			seen[key] = true
+			mergeNodes(path.Child(utils.PathElem{Key: key}), child(base, key), child(ours, key), child(theirs, key), fn)
+		}
+	}
+}
+
+// equal reports whether a and b hold the same values, mapping keys order
+// aside.
+func equal(a, b *yaml.Node) bool {
+	a, b = resolve(a), resolve(b)
+
+	switch {
+	case a == nil || b == nil:
+		return a == b
+	case a.Kind != b.Kind:
+		return false
+	}
+
+	switch a.Kind {
+	case yaml.ScalarNode:
+		return a.Value == b.Value && a.ShortTag() == b.ShortTag()
+	case yaml.MappingNode:
+		if len(a.Content) != len(b.Content) {
+			return false
+		}
+		for i := 0; i+1 < len(a.Content); i += 2 {
+			k, v := utils.MappingEntry(b, a.Content[i].Value)
+			if k == nil || !equal(a.Content[i+1], v) {
+				return false
+			}
+		}
+		return true
+	default:
+		if len(a.Content) != len(b.Content) {
+			return false
+		}
+		for i := range a.Content {
+			if !equal(a.Content[i], b.Content[i]) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func root(node *yaml.Node) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return node.Content[0]
+	}
+	return node
+}
+
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// secretsUnder returns the paths of the encrypted values found at or below
+// path in doc.
+func secretsUnder(doc *decrypt.Document, path utils.Path) []utils.Path {
+	var paths []utils.Path
+
+	node, err := utils.Lookup(doc.Node, path)
+	if err != nil {
+		return nil
+	}
+
+	_ = utils.Walk(node, func(p utils.Path, _ *yaml.Node) error {
+		full := append(append(utils.Path{}, path...), p...)
+		if doc.Secrets[full.String()] {
+			paths = append(paths, full)
+		}
+		return nil
+	})
+
+	return paths
+}
+
+// encryptedPaths returns the paths of the encrypted values of the first
+// document of content.
+func encryptedPaths(content []byte) map[string]bool {
+	paths := map[string]bool{}
+
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(content, &doc); err != nil || doc.Kind != yaml.DocumentNode {
+		return paths
+	}
+
+	_ = utils.Walk(&doc, func(p utils.Path, n *yaml.Node) error {
+		if _, ok := utils.ParseAgeTag(n.Tag); ok && utils.IsAgeArmored(n.Value) {
+			paths[p.String()] = true
+		}
+		return nil
+	})
+
+	return paths
+}
+
+// MergeFile runs git merge-file on the three files, writing the result to
+// ours, and returns the number of conflicts.
+func MergeFile(base, ours, theirs string) (int, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "merge-file", "-L", "ours", "-L", "base", "-L", "theirs", ours, base, theirs)
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 && exitErr.ExitCode() < 128 {
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return 0, fmt.Errorf("git merge-file: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+	yage "sylr.dev/yaml/age/v3"
+)
+
+var (
+	textconvRedactedFlag  bool
+	textconvIdentityFlags []string
+
+	//go:embed textconv_examples.txt
+	textconvExamples string
+)
+
+var TextconvCmd = cobra.Command{
+	Use:          "textconv FILE",
+	Short:        "Render an age file or YAML file for git diff",
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(1),
+	RunE:         RunTextconv,
+	Example:      textconvExamples,
+}
+
+func init() {
+	TextconvCmd.PersistentFlags().StringArrayVarP(&textconvIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	TextconvCmd.PersistentFlags().BoolVar(&textconvRedactedFlag, "redacted", false, "Do not decrypt, only describe encrypted values")
+
+	if err := cobra.MarkFlagFilename(TextconvCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunTextconv(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", args[0], err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var identities []age.Identity
+	if !textconvRedactedFlag {
+		var err error
+		if identities, err = decrypt.Identities(textconvIdentityFlags, args[0] == "-"); err != nil {
+			return err
+		}
+	}
+
+	return Textconv(identities, in, os.Stdout)
+}
+
+// Textconv renders the age file or the YAML documents read from in in a
+// stable way. Encrypted data is decrypted with identities, or described if
+// there are none or if decryption fails. Other files are copied as is.
+func Textconv(identities []age.Identity, in io.Reader, out io.Writer) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(data, []byte("age-encryption.org/")) || bytes.HasPrefix(data, []byte(armor.Header)) {
+		return textconvAge(identities, data, out)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := textconvYAML(identities, data, buf); err != nil {
+		// Not YAML, leave it alone.
+		_, err = out.Write(data)
+		return err
+	}
+
+	_, err = io.Copy(out, buf)
+	return err
+}
+
+func textconvAge(identities []age.Identity, data []byte, out io.Writer) error {
+	if len(identities) > 0 {
+		var in io.Reader = bytes.NewReader(data)
+		if bytes.HasPrefix(data, []byte(armor.Header)) {
+			in = armor.NewReader(in)
+		}
+		r, err := age.Decrypt(in, identities...)
+		if err == nil {
+			_, err = io.Copy(out, r)
+			return err
+		}
+		utils.Warningf("failed to decrypt, showing redacted content: %v", err)
+	}
+
+	h, err := utils.ParseHeader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "age encrypted file (armored: %t, payload: %d bytes, sha256: %s)\nrecipients: %s\n", h.Armored, h.PayloadSize, Fingerprint(data), describe(h))
+	return err
+}
+
+func textconvYAML(identities []age.Identity, data []byte, out io.Writer) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+
+	for {
+		node := yaml.Node{}
+		if err := decoder.Decode(&node); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("yaml decoding failed: %w", err)
+		}
+
+		var doc interface{} = &node
+		decrypted := false
+		if len(identities) > 0 {
+			w := yage.Wrapper{Value: &yaml.Node{}, Identities: identities, DiscardNoTag: true}
+			if err := node.Decode(&w); err == nil {
+				doc, decrypted = &w, true
+			} else {
+				utils.Warningf("failed to decrypt, showing redacted content: %v", err)
+			}
+		}
+
+		if !decrypted {
+			Redact(&node)
+		}
+
+		if err := encoder.Encode(doc); err != nil {
+			return fmt.Errorf("yaml encoding failed: %w", err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("yaml encoding close failed: %w", err)
+	}
+
+	return nil
+}
+
+// Redact replaces the encrypted values of node with a stable description of
+// their recipients and ciphertext, so that encrypting a value again shows up
+// in diffs even if its recipients are the same.
+func Redact(node *yaml.Node) {
+	_ = utils.Walk(node, func(_ utils.Path, n *yaml.Node) error {
+		if _, ok := utils.ParseAgeTag(n.Tag); !ok || !utils.IsAgeArmored(n.Value) {
+			return nil
+		}
+
+		value := strings.TrimSpace(n.Value)
+		n.Style = yaml.DoubleQuotedStyle
+		if h, err := utils.ParseHeader(strings.NewReader(value)); err != nil {
+			n.Value = "<redacted>"
+		} else {
+			n.Value = "<redacted: " + describe(h) + " sha256:" + Fingerprint([]byte(value)) + ">"
+		}
+
+		return nil
+	})
+}
+
+func describe(h *utils.Header) string {
+	var stanzas []string
+	for _, s := range h.Stanzas {
+		stanzas = append(stanzas, s.String())
+	}
+	return strings.Join(stanzas, ",")
+}
+
+// Fingerprint returns a short hash of the ciphertext data, which changes each
+// time a value is encrypted.
+func Fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:4])
+}
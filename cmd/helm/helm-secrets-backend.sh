@@ -0,0 +1,125 @@
+#!/usr/bin/env sh
+#
+# helm-secrets backend using yage.
+#
+#   export HELM_SECRETS_BACKEND=/path/to/this/file
+#
+# Environment:
+#   YAGE_BIN             yage binary (default: yage)
+#   YAGE_IDENTITY        identity file used for decrypting
+#   YAGE_RECIPIENT_FILE  recipient file used for encrypting
+#   YAGE_RECIPIENT       recipient used for encrypting
+#
+# This file is sourced by helm-secrets.
+
+_yage() {
+    "${YAGE_BIN:-yage}" "$@"
+}
+
+_yage_decrypt() {
+    if [ -n "${YAGE_IDENTITY:-}" ]; then
+        _yage decrypt -i "${YAGE_IDENTITY}" "$@"
+    else
+        _yage decrypt "$@"
+    fi
+}
+
+_yage_encrypt() {
+    if [ -n "${YAGE_RECIPIENT_FILE:-}" ]; then
+        set -- -R "${YAGE_RECIPIENT_FILE}" "$@"
+    fi
+    if [ -n "${YAGE_RECIPIENT:-}" ]; then
+        set -- -r "${YAGE_RECIPIENT}" "$@"
+    fi
+    _yage encrypt "$@"
+}
+
+_yage_is_yaml() {
+    case "${1}" in
+    yaml) return 0 ;;
+    auto) case "${2}" in *.yaml | *.yml) return 0 ;; esac ;;
+    esac
+    return 1
+}
+
+_custom_backend_is_file_encrypted() {
+    input="${1}"
+
+    grep -q -e '!crypto/age' -e '-----BEGIN AGE ENCRYPTED FILE-----' "${input}"
+}
+
+_custom_backend_encrypt_file() {
+    type="${1}"
+    input="${2}"
+    output="${3:-}"
+
+    if _yage_is_yaml "${type}" "${input}"; then
+        set -- --yaml
+    else
+        set -- --armor
+    fi
+
+    if [ -z "${output}" ]; then
+        _yage_encrypt "$@" "${input}"
+    else
+        _yage_encrypt "$@" "${input}" > "${output}.yage.tmp"
+        mv "${output}.yage.tmp" "${output}"
+    fi
+}
+
+# _yage_decrypt_file TYPE INPUT OUTPUT [FLAGS...] decrypts INPUT, YAML files
+# with --yaml and the additional FLAGS.
+_yage_decrypt_file() {
+    type="${1}"
+    input="${2}"
+    output="${3}"
+    shift 3
+
+    if _yage_is_yaml "${type}" "${input}"; then
+        set -- --yaml "$@"
+    else
+        set --
+    fi
+
+    if [ -z "${output}" ]; then
+        _yage_decrypt "$@" "${input}"
+    else
+        _yage_decrypt "$@" "${input}" > "${output}"
+    fi
+}
+
+_custom_backend_decrypt_file() {
+    _yage_decrypt_file "${1}" "${2}" "${3:-}" --yaml-notag
+}
+
+_custom_backend_decrypt_literal() {
+    literal="${1}"
+
+    case "${literal}" in
+    "-----BEGIN AGE ENCRYPTED FILE-----"*) printf '%s\n' "${literal}" | _yage_decrypt ;;
+    *) printf '%s' "${literal}" ;;
+    esac
+}
+
+_custom_backend_edit_file() {
+    type="${1}"
+    input="${2}"
+
+    # The temporary file has no extension to detect the type from.
+    if _yage_is_yaml "${type}" "${input}"; then
+        type=yaml
+    fi
+
+    tmp="$(mktemp)"
+
+    # Keep the tags so that the values are encrypted again.
+    if [ -f "${input}" ] && ! _yage_decrypt_file "${type}" "${input}" "${tmp}"; then
+        rm -f "${tmp}"
+        return 1
+    fi
+    if ! "${EDITOR:-vi}" "${tmp}" || ! _custom_backend_encrypt_file "${type}" "${tmp}" "${input}"; then
+        rm -f "${tmp}"
+        return 1
+    fi
+    rm -f "${tmp}"
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package helm
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/k8s"
+)
+
+var (
+	postRendererIdentityFlags []string
+
+	//go:embed post_renderer_examples.txt
+	postRendererExamples string
+
+	//go:embed helm-secrets-backend.sh
+	backendScript string
+
+	//go:embed backend_examples.txt
+	backendExamples string
+)
+
+var HelmCmd = cobra.Command{
+	Use:          "helm",
+	Short:        "Helm integration helpers",
+	GroupID:      "age",
+	SilenceUsage: true,
+}
+
+var PostRendererCmd = cobra.Command{
+	Use:          "post-renderer",
+	Short:        "Decrypt the manifests rendered by helm read from stdin",
+	Long:         "Decrypt the manifests rendered by helm read from stdin.\n\nWhen invoked as yage-post-renderer, yage runs this command so that it can be\nused with helm versions which can't pass arguments to post-renderers.",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         RunPostRenderer,
+	Example:      postRendererExamples,
+}
+
+var BackendCmd = cobra.Command{
+	Use:          "secrets-backend",
+	Short:        "Print a helm-secrets backend script using yage",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE: func(_ *cobra.Command, _ []string) error {
+		_, err := io.WriteString(os.Stdout, backendScript)
+		return err
+	},
+	Example: backendExamples,
+}
+
+func init() {
+	HelmCmd.AddCommand(&PostRendererCmd)
+	HelmCmd.AddCommand(&ValuesCmd)
+	HelmCmd.AddCommand(&BackendCmd)
+
+	PostRendererCmd.PersistentFlags().StringArrayVarP(&postRendererIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	if err := cobra.MarkFlagFilename(PostRendererCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunPostRenderer(_ *cobra.Command, _ []string) error {
+	log.SetFlags(0)
+
+	identities, err := decrypt.Identities(postRendererIdentityFlags, true)
+	if err != nil {
+		return err
+	}
+
+	return PostRender(identities, os.Stdin, os.Stdout)
+}
+
+// PostRender decrypts the manifests read from in like the KRM function does
+// and writes them to out.
+func PostRender(identities []age.Identity, in io.Reader, out io.Writer) error {
+	decoder := yaml.NewDecoder(in)
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+
+	for {
+		raw := yaml.Node{}
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("yaml decoding failed: %w", err)
+		}
+
+		if len(raw.Content) == 0 || raw.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		node, err := k8s.DecryptItem(identities, &raw)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(node); err != nil {
+			return fmt.Errorf("yaml encoding failed: %w", err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("yaml encoding close failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !unix
+
+package helm
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func pipeFile(_ *exec.Cmd, _ []byte) (string, func(), error) {
+	return "", nil, fmt.Errorf("passing values through pipes is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build unix
+
+package helm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// pipeFile hands the read end of an anonymous pipe to cmd and returns the
+// path cmd can open it with, and the function writing content to it which
+// must be called once cmd is started.
+func pipeFile(cmd *exec.Cmd, content []byte) (string, func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", nil, err
+	}
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	path := fmt.Sprintf("/dev/fd/%d", 2+len(cmd.ExtraFiles))
+
+	write := func() {
+		// The child has its own copy of the read end.
+		r.Close()
+		// Writing fails with EPIPE if helm does not read the file.
+		if _, err := w.Write(content); err != nil && !errors.Is(err, syscall.EPIPE) {
+			log.Printf("yage: failed to write %s: %v", path, err)
+		}
+		w.Close()
+	}
+
+	return path, write, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package helm
+
+import (
+	"bytes"
+	_ "embed"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	yageexec "sylr.dev/yage/v2/cmd/exec"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	valuesIdentityFlags []string
+	valuesHelmFlag      string
+
+	//go:embed values_examples.txt
+	valuesExamples string
+)
+
+var ValuesCmd = cobra.Command{
+	Use:          "values [flags] -- HELM_ARG...",
+	Short:        "Run helm with its encrypted values files decrypted into pipes",
+	SilenceUsage: true,
+	Args:         cobra.MinimumNArgs(1),
+	RunE:         RunValues,
+	Example:      valuesExamples,
+}
+
+func init() {
+	ValuesCmd.Flags().SetInterspersed(false)
+	ValuesCmd.PersistentFlags().StringArrayVarP(&valuesIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	ValuesCmd.PersistentFlags().StringVar(&valuesHelmFlag, "helm", "helm", "Helm binary to run")
+
+	if err := cobra.MarkFlagFilename(ValuesCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunValues(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	cmd := exec.Command(valuesHelmFlag)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	var writers []func()
+	var decryptErr error
+
+	args = MapValueFiles(args, func(name string) string {
+		if decryptErr != nil {
+			return name
+		}
+
+		content, err := os.ReadFile(name)
+		if err != nil || !bytes.Contains(content, []byte(utils.AgeTag)) {
+			// Remote or plain values files are left to helm.
+			return name
+		}
+
+		buf := &bytes.Buffer{}
+		err = decrypt.DecryptYAML(valuesIdentityFlags, bytes.NewReader(content), buf, false, true, false, filepath.Dir(name))
+		if err != nil {
+			decryptErr = err
+			return name
+		}
+
+		path, write, err := pipeFile(cmd, buf.Bytes())
+		if err != nil {
+			decryptErr = err
+			return name
+		}
+		writers = append(writers, write)
+
+		return path
+	})
+	if decryptErr != nil {
+		return decryptErr
+	}
+
+	cmd.Args = append(cmd.Args, args...)
+
+	os.Exit(yageexec.RunCommand(cmd, func() {
+		for _, w := range writers {
+			go w()
+		}
+	}))
+
+	return nil
+}
+
+// MapValueFiles returns a copy of helm args in which the values files given
+// with -f or --values are replaced by the result of fn.
+func MapValueFiles(args []string, fn func(string) string) []string {
+	out := make([]string, 0, len(args))
+
+	mapList := func(list string) string {
+		files := strings.Split(list, ",")
+		for i, f := range files {
+			files[i] = fn(f)
+		}
+		return strings.Join(files, ",")
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return append(out, args[i:]...)
+		case (arg == "-f" || arg == "--values") && i+1 < len(args):
+			out = append(out, arg, mapList(args[i+1]))
+			i++
+		case strings.HasPrefix(arg, "--values="):
+			out = append(out, "--values="+mapList(strings.TrimPrefix(arg, "--values=")))
+		case strings.HasPrefix(arg, "-f="):
+			out = append(out, "-f="+mapList(strings.TrimPrefix(arg, "-f=")))
+		case strings.HasPrefix(arg, "-f") && len(arg) > 2 && arg[2] != '-':
+			out = append(out, "-f"+mapList(arg[2:]))
+		default:
+			out = append(out, arg)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package history
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/diff"
+	"sylr.dev/yage/v2/cmd/git"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	identityFlags []string
+	jsonFlag      bool
+	revealFlag    bool
+
+	//go:embed examples.txt
+	examples string
+)
+
+var LogCmd = cobra.Command{
+	Use:          "log FILE PATH",
+	Short:        "Show the git revisions in which a value changed",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	LogCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	LogCmd.PersistentFlags().BoolVar(&jsonFlag, "json", false, "Output as JSON")
+	LogCmd.PersistentFlags().BoolVar(&revealFlag, "reveal", false, "Show the decrypted values")
+
+	if err := cobra.MarkFlagFilename(LogCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+// Revision describes a commit in which the value changed, or in which the
+// file could not be decrypted.
+type Revision struct {
+	Commit string  `json:"commit"`
+	Author string  `json:"author"`
+	Date   string  `json:"date"`
+	Change string  `json:"change"`
+	Value  *string `json:"value,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	path, err := utils.ParsePath(args[1])
+	if err != nil {
+		return err
+	}
+
+	identities, err := decrypt.Identities(identityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	revs, err := Log(identities, args[0], path)
+	if err != nil {
+		return err
+	}
+
+	if !revealFlag {
+		for i := range revs {
+			revs[i].Value = nil
+		}
+	}
+
+	if jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(revs)
+	}
+
+	return WriteTable(os.Stdout, revs)
+}
+
+type commit struct {
+	hash, author, date, name string
+}
+
+// Log returns, newest first, the commits in which the value found at path in
+// the git tracked file name was added, changed or removed. Values are
+// compared once decrypted with identities and are returned rendered on a
+// single line. Commits in which the file cannot be decrypted are returned as
+// undecryptable, and the values of the following ones are compared to the
+// last value decrypted.
+func Log(identities []age.Identity, name string, path utils.Path) ([]Revision, error) {
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+
+	out, err := git.Git("-C", dir, "log", "--follow", "--diff-merges=first-parent", "--name-only",
+		"--format=%x1e%H%x1f%an <%ae>%x1f%aI", "--", base)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []commit
+	for _, record := range strings.Split(string(out), "\x1e") {
+		lines := strings.Split(strings.TrimSpace(record), "\n")
+		fields := strings.Split(lines[0], "\x1f")
+		if len(fields) != 3 {
+			continue
+		}
+		c := commit{hash: fields[0], author: fields[1], date: fields[2]}
+		for _, l := range lines[1:] {
+			if l = strings.TrimSpace(l); l != "" {
+				c.name = l
+			}
+		}
+		if c.name == "" && len(commits) > 0 {
+			c.name = commits[len(commits)-1].name
+		}
+		commits = append(commits, c)
+	}
+
+	var revs []Revision
+	var prev *string
+
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+
+		value, err := valueAt(identities, dir, c, path)
+		if err != nil {
+			revs = append(revs, Revision{Commit: c.hash, Author: c.author, Date: c.date, Change: "undecryptable", Error: err.Error()})
+			continue
+		}
+
+		var change string
+		switch {
+		case prev == nil && value == nil:
+			continue
+		case prev == nil:
+			change = "added"
+		case value == nil:
+			change = "removed"
+		case *prev == *value:
+			continue
+		default:
+			change = "changed"
+		}
+
+		revs = append(revs, Revision{Commit: c.hash, Author: c.author, Date: c.date, Change: change, Value: value})
+		prev = value
+	}
+
+	for i, j := 0, len(revs)-1; i < j; i, j = i+1, j-1 {
+		revs[i], revs[j] = revs[j], revs[i]
+	}
+
+	return revs, nil
+}
+
+// valueAt returns the rendered value found at path in the file at commit c,
+// or nil if there is none.
+func valueAt(identities []age.Identity, dir string, c commit, path utils.Path) (*string, error) {
+	if c.name == "" {
+		return nil, nil
+	}
+
+	content, err := git.Git("-C", dir, "show", c.hash+":"+c.name)
+	if err != nil {
+		// The file does not exist at this revision.
+		return nil, nil
+	}
+
+	docs, err := decrypt.DecryptDocuments(identities, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	node, err := utils.Lookup(docs[0].Node, path)
+	if errors.Is(err, utils.ErrPathNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	value := diff.Render(node)
+	return &value, nil
+}
+
+// WriteTable writes revs as an aligned table, with values if they are set.
+func WriteTable(out io.Writer, revs []Revision) error {
+	reveal := false
+	for _, r := range revs {
+		reveal = reveal || r.Value != nil
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	header := "COMMIT\tDATE\tAUTHOR\tCHANGE"
+	if reveal {
+		header += "\tVALUE"
+	}
+	fmt.Fprintln(tw, header)
+
+	for _, r := range revs {
+		line := fmt.Sprintf("%.12s\t%s\t%s\t%s", r.Commit, r.Date, r.Author, r.Change)
+		if reveal {
+			value := "-"
+			if r.Value != nil {
+				value = *r.Value
+			}
+			line += "\t" + value
+		}
+		fmt.Fprintln(tw, line)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package inspect
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age/armor"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/ssh"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	jsonFlag           bool
+	recipientFlags     []string
+	recipientFileFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var InspectCmd = cobra.Command{
+	Use:          "inspect [FILE [PATH]]",
+	Short:        "Show the recipients of AGE encrypted data without decrypting it",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.MaximumNArgs(2),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	InspectCmd.PersistentFlags().BoolVar(&jsonFlag, "json", false, "Output as JSON")
+	InspectCmd.PersistentFlags().StringArrayVarP(&recipientFlags, "recipient", "r", []string{}, "Recipient public key to match stanzas against")
+	InspectCmd.PersistentFlags().StringArrayVarP(&recipientFileFlags, "recipient-file", "R", []string{}, "Recipient public key file to match stanzas against")
+
+	if err := cobra.MarkFlagFilename(InspectCmd.PersistentFlags(), "recipient-file"); err != nil {
+		panic(err)
+	}
+}
+
+// Report is the result of the inspection of an age file.
+type Report struct {
+	*utils.Header
+	Matches map[string][]string `json:"matches,omitempty"`
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	var in io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", args[0], err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var path utils.Path
+	if len(args) > 1 {
+		var err error
+		if path, err = utils.ParsePath(args[1]); err != nil {
+			return err
+		}
+	}
+
+	known, err := KnownSSHKeys(recipientFlags, recipientFileFlags)
+	if err != nil {
+		return err
+	}
+
+	report, err := Inspect(in, path, len(args) > 1, known)
+	if err != nil {
+		return err
+	}
+
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	return WriteReport(os.Stdout, report)
+}
+
+// Inspect parses the age file read from in, or the age encrypted value found
+// at path if in is YAML and yamlPath is set, and matches its ssh stanzas
+// against known, a map of ssh key tags to key descriptions.
+func Inspect(in io.Reader, path utils.Path, yamlPath bool, known map[string][]string) (*Report, error) {
+	rr := bufio.NewReader(in)
+	start, _ := rr.Peek(len(armor.Header))
+	isAge := bytes.HasPrefix(start, []byte("age-encryption.org/")) || string(start) == armor.Header
+
+	if !isAge {
+		if !yamlPath {
+			return nil, fmt.Errorf("input is not an age file, a PATH is needed to inspect a YAML value")
+		}
+
+		doc := yaml.Node{}
+		if err := yaml.NewDecoder(rr).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("yaml decoding failed: %w", err)
+		}
+		node, err := utils.Lookup(&doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !utils.IsAgeArmored(node.Value) {
+			return nil, fmt.Errorf("%s is not an age encrypted value", path)
+		}
+		in = strings.NewReader(strings.TrimSpace(node.Value))
+	} else {
+		in = rr
+	}
+
+	h, err := utils.ParseHeader(in)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Header: h, Matches: map[string][]string{}}
+	for _, s := range h.Stanzas {
+		if m, ok := known[s.KeyTag]; ok && s.KeyTag != "" {
+			report.Matches[s.KeyTag] = m
+		}
+	}
+
+	return report, nil
+}
+
+// KnownSSHKeys returns the tags of the ssh keys found in ~/.ssh/*.pub, in the
+// given recipient files and recipients, along with a description of where
+// they were found.
+func KnownSSHKeys(recipients, files []string) (map[string][]string, error) {
+	known := map[string][]string{}
+
+	add := func(line, where string) {
+		pk, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return
+		}
+		desc := where
+		if comment != "" {
+			desc += " (" + comment + ")"
+		}
+		tag := utils.SSHKeyTag(pk)
+		known[tag] = append(known[tag], desc)
+	}
+
+	pubs, _ := filepath.Glob(os.ExpandEnv("$HOME/.ssh/*.pub"))
+	for _, name := range pubs {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		add(string(content), name)
+	}
+
+	for _, name := range files {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recipient file %q: %w", name, err)
+		}
+		for n, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "ssh-") {
+				add(line, fmt.Sprintf("%s:%d", name, n+1))
+			}
+		}
+	}
+
+	for _, r := range recipients {
+		if strings.HasPrefix(r, "ssh-") {
+			add(r, "-r")
+		}
+	}
+
+	return known, nil
+}
+
+func WriteReport(out io.Writer, r *Report) error {
+	fmt.Fprintf(out, "armored: %t\n", r.Armored)
+	fmt.Fprintf(out, "size: %d bytes (payload: %d bytes)\n", r.Size, r.PayloadSize)
+	fmt.Fprintf(out, "recipients: %d\n", len(r.Stanzas))
+
+	for _, s := range r.Stanzas {
+		switch s.Type {
+		case "X25519":
+			fmt.Fprintf(out, "  - %s (recipient can't be identified from the header)\n", s.Type)
+		case "scrypt":
+			fmt.Fprintf(out, "  - %s (passphrase, work factor %d)\n", s.Type, s.WorkFactor)
+		case "ssh-ed25519", "ssh-rsa":
+			if m, ok := r.Matches[s.KeyTag]; ok {
+				fmt.Fprintf(out, "  - %s %s matches %s\n", s.Type, s.KeyTag, strings.Join(m, ", "))
+			} else {
+				fmt.Fprintf(out, "  - %s %s (unknown key)\n", s.Type, s.KeyTag)
+			}
+		default:
+			fmt.Fprintf(out, "  - %s %s\n", s.Type, strings.Join(s.Args, " "))
+		}
+	}
+
+	return nil
+}
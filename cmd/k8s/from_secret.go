@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package k8s
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	fromSecretOutFlag        string
+	fromSecretRecipientFlags []string
+	fromSecretRecipientFiles []string
+	fromSecretIdentityFlags  []string
+
+	//go:embed from_secret_examples.txt
+	fromSecretExamples string
+)
+
+var FromSecretCmd = cobra.Command{
+	Use:          "from-secret [MANIFEST]",
+	Short:        "Turn a Kubernetes Secret manifest into a YAML file with encrypted values",
+	SilenceUsage: true,
+	Args:         cobra.MaximumNArgs(1),
+	RunE:         RunFromSecret,
+	Example:      fromSecretExamples,
+}
+
+func init() {
+	FromSecretCmd.PersistentFlags().StringVarP(&fromSecretOutFlag, "output", "o", "", "Output to `FILE` (default stdout)")
+	FromSecretCmd.PersistentFlags().StringArrayVarP(&fromSecretRecipientFlags, "recipient", "r", []string{}, "Recipient public key")
+	FromSecretCmd.PersistentFlags().StringArrayVarP(&fromSecretRecipientFiles, "recipient-file", "R", []string{}, "Recipient public key file")
+	FromSecretCmd.PersistentFlags().StringArrayVarP(&fromSecretIdentityFlags, "identity", "i", []string{}, "Identity private key (used to derive public key which will be added as recipient)")
+
+	if err := cobra.MarkFlagFilename(FromSecretCmd.PersistentFlags(), "recipient-file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(FromSecretCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunFromSecret(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	if len(fromSecretRecipientFlags)+len(fromSecretRecipientFiles)+len(fromSecretIdentityFlags) == 0 {
+		return fmt.Errorf("missing recipients.\n" +
+			"Did you forget to specify -r/--recipient or -R/--recipient-file?")
+	}
+
+	var in io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", args[0], err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if fromSecretOutFlag != "" && fromSecretOutFlag != "-" {
+		if _, err := os.Stat(fromSecretOutFlag); err == nil {
+			return fmt.Errorf("output file %q exists", fromSecretOutFlag)
+		}
+	}
+
+	secret := Secret{}
+	if err := yaml.NewDecoder(in).Decode(&secret); err != nil {
+		return fmt.Errorf("yaml decoding failed: %w", err)
+	}
+	if secret.Kind != "Secret" {
+		return fmt.Errorf("not a Secret but a %q", secret.Kind)
+	}
+
+	recipients, err := encrypt.Recipients(fromSecretRecipientFlags, fromSecretRecipientFiles, fromSecretIdentityFlags, in == os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	if fromSecretOutFlag != "" && fromSecretOutFlag != "-" {
+		f := utils.NewLazyOpenerPerm(fromSecretOutFlag, false, 0o600)
+		if err := FromSecret(recipients, &secret, f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	return FromSecret(recipients, &secret, os.Stdout)
+}
+
+// FromSecret writes the values of secret, encrypted and tagged, to the data
+// mapping of a YAML document written to out. Values of stringData take
+// precedence over the ones of data like they do in Kubernetes. Binary values
+// of data are kept base64 encoded and tagged with utils.BinaryAttribute. The
+// kind, name, namespace and type of secret are kept in plain text, see
+// SecretMetadata.
+func FromSecret(recipients []age.Recipient, secret *Secret, out io.Writer) error {
+	values := map[string]string{}
+	binary := map[string]bool{}
+	for k, v := range secret.Data {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("data.%s: %w", k, err)
+		}
+		values[k] = string(b)
+		if !utf8.Valid(b) {
+			values[k], binary[k] = v, true
+		}
+	}
+	for k, v := range secret.StringData {
+		values[k] = v
+		delete(binary, k)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	str := func(v string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	}
+
+	metadata := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if secret.Metadata.Name != "" {
+		metadata.Content = append(metadata.Content, str("name"), str(secret.Metadata.Name))
+	}
+	if secret.Metadata.Namespace != "" {
+		metadata.Content = append(metadata.Content, str("namespace"), str(secret.Metadata.Namespace))
+	}
+
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, k := range keys {
+		tag := utils.AgeTag
+		switch {
+		case binary[k]:
+			tag += ":" + utils.BinaryAttribute
+		case strings.Contains(values[k], "\n"):
+			tag += ":Literal"
+		}
+		mapping.Content = append(mapping.Content,
+			str(k),
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: values[k]},
+		)
+	}
+
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	root.Content = append(root.Content, str("kind"), str(secret.Kind), str("metadata"), metadata)
+	if secret.Type != "" {
+		root.Content = append(root.Content, str("type"), str(secret.Type))
+	}
+	root.Content = append(root.Content, str("data"), mapping)
+
+	plain, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+
+	return encrypt.EncryptYAML(recipients, bytes.NewReader(plain), out)
+}
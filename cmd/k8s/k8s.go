@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package k8s
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var K8sCmd = cobra.Command{
+	Use:          "k8s",
+	Aliases:      []string{"kubernetes"},
+	Short:        "Kubernetes integration helpers",
+	GroupID:      "age",
+	SilenceUsage: true,
+}
+
+func init() {
+	K8sCmd.AddCommand(&SecretCmd)
+	K8sCmd.AddCommand(&FromSecretCmd)
+	K8sCmd.AddCommand(&KRMCmd)
+}
+
+// Secret is a v1/Secret manifest.
+type Secret struct {
+	APIVersion string            `yaml:"apiVersion" json:"apiVersion"`
+	Kind       string            `yaml:"kind" json:"kind"`
+	Metadata   Metadata          `yaml:"metadata" json:"metadata"`
+	Type       string            `yaml:"type,omitempty" json:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty" json:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty" json:"stringData,omitempty"`
+}
+
+// Metadata holds the metadata of a Kubernetes object yage cares about.
+type Metadata struct {
+	Name        string            `yaml:"name" json:"name"`
+	Namespace   string            `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+}
@@ -0,0 +1,324 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package k8s
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	krmIdentityFlags []string
+
+	//go:embed krm_examples.txt
+	krmExamples string
+)
+
+var KRMCmd = cobra.Command{
+	Use:          "krm",
+	Short:        "Decrypt the items of a KRM function ResourceList read from stdin",
+	Long:         "Decrypt the items of a KRM function ResourceList read from stdin.\n\nWhen invoked as yage-krm, yage runs this command so that it can be used as a\nkustomize exec function.",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         RunKRM,
+	Example:      krmExamples,
+}
+
+func init() {
+	KRMCmd.PersistentFlags().StringArrayVarP(&krmIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	if err := cobra.MarkFlagFilename(KRMCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+// FunctionConfig configures the KRM function. It is read from the data of a
+// ConfigMap or from the spec of any other kind of functionConfig.
+type FunctionConfig struct {
+	// IdentityFiles lists identity files to decrypt with.
+	IdentityFiles []string `yaml:"identityFiles"`
+	// IdentityEnv names an environment variable holding age identities.
+	IdentityEnv string `yaml:"identityEnv"`
+	// Kinds restricts decryption to items of these kinds.
+	Kinds []string `yaml:"kinds"`
+}
+
+// Result is a KRM function result.
+type Result struct {
+	Message     string       `yaml:"message"`
+	Severity    string       `yaml:"severity"`
+	ResourceRef *ResourceRef `yaml:"resourceRef,omitempty"`
+}
+
+// ResourceRef identifies the item a Result is about.
+type ResourceRef struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Name       string `yaml:"name"`
+	Namespace  string `yaml:"namespace,omitempty"`
+}
+
+func RunKRM(_ *cobra.Command, _ []string) error {
+	log.SetFlags(0)
+
+	out, failed, err := KRM(krmIdentityFlags, os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stdout.Write(out); err != nil {
+		return err
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// KRM decrypts the items of the ResourceList read from in and returns it
+// encoded, along with whether errors were reported in its results.
+func KRM(keys []string, in io.Reader) ([]byte, bool, error) {
+	doc := yaml.Node{}
+	if err := yaml.NewDecoder(in).Decode(&doc); err != nil {
+		return nil, false, fmt.Errorf("yaml decoding failed: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, false, fmt.Errorf("input is not a ResourceList")
+	}
+	list := doc.Content[0]
+
+	if _, kind := utils.MappingEntry(list, "kind"); kind == nil || kind.Value != "ResourceList" {
+		return nil, false, fmt.Errorf("input is not a ResourceList")
+	}
+
+	var results []Result
+	failed := false
+	report := func(ref *ResourceRef, err error) {
+		results = append(results, Result{Message: err.Error(), Severity: "error", ResourceRef: ref})
+		failed = true
+	}
+
+	config, err := functionConfig(list)
+	if err != nil {
+		report(nil, err)
+	}
+
+	identities, err := decrypt.Identities(append(append([]string{}, keys...), config.IdentityFiles...), true)
+	if err != nil {
+		report(nil, err)
+	}
+	if config.IdentityEnv != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(os.Getenv(config.IdentityEnv)))
+		if err != nil {
+			report(nil, fmt.Errorf("%s: %w", config.IdentityEnv, err))
+		}
+		identities = append(identities, ids...)
+	}
+
+	if _, items := utils.MappingEntry(list, "items"); items != nil && items.Kind == yaml.SequenceNode && !failed {
+		for i, item := range items.Content {
+			ref := resourceRef(item)
+			if len(config.Kinds) > 0 && !slices.Contains(config.Kinds, ref.Kind) {
+				continue
+			}
+
+			decrypted, err := DecryptItem(identities, item)
+			if err != nil {
+				report(ref, err)
+				continue
+			}
+			items.Content[i] = decrypted
+		}
+	}
+
+	if len(results) > 0 {
+		node := &yaml.Node{}
+		if err := node.Encode(results); err != nil {
+			return nil, false, err
+		}
+		if k, v := utils.MappingEntry(list, "results"); k != nil {
+			v.Content = append(v.Content, node.Content...)
+		} else {
+			list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "results"}, node)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, false, fmt.Errorf("yaml encoding failed: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, false, fmt.Errorf("yaml encoding close failed: %w", err)
+	}
+
+	return buf.Bytes(), failed, nil
+}
+
+// DecryptItem returns item with its !crypto/age tagged values decrypted and
+// untagged. The data of Secrets is base64 encoded once decrypted, and the
+// data and stringData values of Secrets holding whole age files are
+// decrypted too.
+func DecryptItem(identities []age.Identity, item *yaml.Node) (*yaml.Node, error) {
+	d, err := decrypt.DecryptDocument(identities, item)
+	if err != nil {
+		return nil, err
+	}
+	node := d.Node
+
+	if _, kind := utils.MappingEntry(node, "kind"); kind == nil || kind.Value != "Secret" {
+		return node, nil
+	}
+
+	if _, data := utils.MappingEntry(node, "data"); data != nil && data.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(data.Content); i += 2 {
+			key, v := data.Content[i].Value, data.Content[i+1]
+			if v.Kind != yaml.ScalarNode {
+				continue
+			}
+
+			if d.IsSecret(utils.Path{{Key: "data"}, {Key: key}}) {
+				setString(v, base64.StdEncoding.EncodeToString([]byte(v.Value)))
+				continue
+			}
+
+			b, err := base64.StdEncoding.DecodeString(v.Value)
+			if err != nil || !isAgeFile(b) {
+				continue
+			}
+			plain, err := decryptFile(identities, b)
+			if err != nil {
+				return nil, fmt.Errorf("data.%s: %w", key, err)
+			}
+			setString(v, base64.StdEncoding.EncodeToString(plain))
+		}
+	}
+
+	if _, data := utils.MappingEntry(node, "stringData"); data != nil && data.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(data.Content); i += 2 {
+			key, v := data.Content[i].Value, data.Content[i+1]
+			if v.Kind != yaml.ScalarNode || !isAgeFile([]byte(v.Value)) {
+				continue
+			}
+			plain, err := decryptFile(identities, []byte(v.Value))
+			if err != nil {
+				return nil, fmt.Errorf("stringData.%s: %w", key, err)
+			}
+			setString(v, string(plain))
+		}
+	}
+
+	return node, nil
+}
+
+func functionConfig(list *yaml.Node) (FunctionConfig, error) {
+	config := FunctionConfig{}
+
+	_, fc := utils.MappingEntry(list, "functionConfig")
+	if fc == nil || fc.Kind != yaml.MappingNode {
+		return config, nil
+	}
+
+	if _, kind := utils.MappingEntry(fc, "kind"); kind != nil && kind.Value == "ConfigMap" {
+		data := map[string]string{}
+		if _, d := utils.MappingEntry(fc, "data"); d != nil {
+			if err := d.Decode(&data); err != nil {
+				return config, fmt.Errorf("functionConfig: %w", err)
+			}
+		}
+		config.IdentityFiles = splitList(data["identityFiles"])
+		config.IdentityEnv = data["identityEnv"]
+		config.Kinds = splitList(data["kinds"])
+		return config, nil
+	}
+
+	if _, spec := utils.MappingEntry(fc, "spec"); spec != nil {
+		if err := spec.Decode(&config); err != nil {
+			return config, fmt.Errorf("functionConfig: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+func resourceRef(item *yaml.Node) *ResourceRef {
+	ref := &ResourceRef{}
+	value := func(node *yaml.Node, key string) string {
+		if node == nil {
+			return ""
+		}
+		if _, v := utils.MappingEntry(node, key); v != nil {
+			return v.Value
+		}
+		return ""
+	}
+
+	ref.APIVersion = value(item, "apiVersion")
+	ref.Kind = value(item, "kind")
+	_, metadata := utils.MappingEntry(item, "metadata")
+	ref.Name = value(metadata, "name")
+	ref.Namespace = value(metadata, "namespace")
+
+	return ref
+}
+
+func isAgeFile(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("age-encryption.org/")) || utils.IsAgeArmored(string(b))
+}
+
+func decryptFile(identities []age.Identity, b []byte) ([]byte, error) {
+	var in io.Reader = bytes.NewReader(b)
+	if utils.IsAgeArmored(string(b)) {
+		in = armor.NewReader(bytes.NewReader(bytes.TrimSpace(b)))
+	}
+
+	r, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func setString(n *yaml.Node, value string) {
+	n.Tag = "!!str"
+	n.Style = 0
+	if strings.Contains(value, "\n") {
+		n.Style = yaml.LiteralStyle
+	}
+	n.Value = value
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package k8s
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	secretIdentityFlags  []string
+	secretPathFlags      []string
+	secretLabelFlags     []string
+	secretNameFlag       string
+	secretNamespaceFlag  string
+	secretTypeFlag       string
+	secretStringDataFlag bool
+
+	//go:embed secret_examples.txt
+	secretExamples string
+)
+
+var SecretCmd = cobra.Command{
+	Use:          "secret [--name NAME] [FILE]",
+	Short:        "Generate a Kubernetes Secret from the decrypted values of a YAML file",
+	SilenceUsage: true,
+	Args:         cobra.MaximumNArgs(1),
+	RunE:         RunSecret,
+	Example:      secretExamples,
+}
+
+func init() {
+	SecretCmd.PersistentFlags().StringArrayVarP(&secretIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	SecretCmd.PersistentFlags().StringArrayVar(&secretPathFlags, "path", []string{}, "Path of a value, or of a mapping of values, to put in the Secret (default \".\")")
+	SecretCmd.PersistentFlags().StringVar(&secretNameFlag, "name", "", "Name of the Secret (default the name kept by from-secret)")
+	SecretCmd.PersistentFlags().StringVarP(&secretNamespaceFlag, "namespace", "n", "", "Namespace of the Secret (default the namespace kept by from-secret)")
+	SecretCmd.PersistentFlags().StringArrayVarP(&secretLabelFlags, "label", "l", []string{}, "Label of the Secret, as `KEY=VALUE`")
+	SecretCmd.PersistentFlags().StringVar(&secretTypeFlag, "type", "Opaque", "Type of the Secret, unless kept by from-secret")
+	SecretCmd.PersistentFlags().BoolVar(&secretStringDataFlag, "string-data", false, "Use stringData instead of base64 encoded data")
+
+	if err := cobra.MarkFlagFilename(SecretCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunSecret(cmd *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	var in io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open input file %q: %w", args[0], err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	labels := map[string]string{}
+	for _, l := range secretLabelFlags {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			return fmt.Errorf("invalid label %q, expected KEY=VALUE", l)
+		}
+		labels[k] = v
+	}
+
+	var paths []utils.Path
+	for _, p := range secretPathFlags {
+		path, err := utils.ParsePath(p)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		paths = append(paths, utils.Path{})
+	}
+
+	identities, err := decrypt.Identities(secretIdentityFlags, in == os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	docs, err := decrypt.DecryptDocuments(identities, in)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("no YAML document")
+	}
+
+	name, namespace, typ := secretNameFlag, secretNamespaceFlag, secretTypeFlag
+	if n, ns, t, ok := SecretMetadata(&docs[0]); ok {
+		if name == "" {
+			name = n
+		}
+		if namespace == "" {
+			namespace = ns
+		}
+		if t != "" && !cmd.Flags().Changed("type") {
+			typ = t
+		}
+		if len(secretPathFlags) == 0 {
+			paths = []utils.Path{{{Key: "data"}}}
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("missing Secret name.\n" +
+			"Did you forget to specify --name?")
+	}
+
+	values, err := SecretValues(&docs[0], paths)
+	if err != nil {
+		return err
+	}
+	if secretStringDataFlag {
+		for k, v := range values {
+			if !utf8.ValidString(v) {
+				return fmt.Errorf("%q is binary and can only be written to data", k)
+			}
+		}
+	}
+
+	secret := NewSecret(name, namespace, typ, labels, values, secretStringDataFlag)
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+	if err := encoder.Encode(secret); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// SecretMetadata returns the name, namespace and type of the Secret kept by
+// FromSecret in doc, and whether doc was written by FromSecret.
+func SecretMetadata(doc *decrypt.Document) (name, namespace, typ string, ok bool) {
+	value := func(p ...string) string {
+		var path utils.Path
+		for _, k := range p {
+			path = path.Child(utils.PathElem{Key: k})
+		}
+		n, err := utils.Lookup(doc.Node, path)
+		if err != nil || n.Kind != yaml.ScalarNode {
+			return ""
+		}
+		return n.Value
+	}
+
+	if value("kind") != "Secret" {
+		return "", "", "", false
+	}
+
+	return value("metadata", "name"), value("metadata", "namespace"), value("type"), true
+}
+
+var secretKeyRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// SecretValues returns the values found at paths in doc, indexed by Secret
+// key. A path pointing to a scalar gives a single value named after its last
+// key, a path pointing to a mapping gives one value per entry. Collections
+// are rendered as YAML, and binary values are base64 decoded.
+func SecretValues(doc *decrypt.Document, paths []utils.Path) (map[string]string, error) {
+	values := map[string]string{}
+
+	add := func(path utils.Path, key string, n *yaml.Node) error {
+		if !secretKeyRegexp.MatchString(key) {
+			return fmt.Errorf("%s: %q is not a valid Secret key", path, key)
+		}
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("%s: duplicate Secret key %q", path, key)
+		}
+
+		if n.Kind == yaml.ScalarNode {
+			values[key] = n.Value
+			if n.ShortTag() == "!!null" {
+				values[key] = ""
+			}
+			if doc.Binary[path.String()] {
+				b, err := base64.StdEncoding.DecodeString(n.Value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+				values[key] = string(b)
+			}
+			return nil
+		}
+
+		b, err := yaml.Marshal(n)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		values[key] = string(b)
+
+		return nil
+	}
+
+	for _, path := range paths {
+		n, err := utils.Lookup(doc.Node, path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case n.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := n.Content[i].Value
+				if err := add(path.Child(utils.PathElem{Key: key}), key, n.Content[i+1]); err != nil {
+					return nil, err
+				}
+			}
+		case len(path) > 0 && !path[len(path)-1].IsIndex:
+			if err := add(path, path[len(path)-1].Key, n); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%s: neither a mapping nor a named value", path)
+		}
+	}
+
+	return values, nil
+}
+
+// NewSecret returns a Secret holding values, base64 encoded in data unless
+// stringData is set.
+func NewSecret(name, namespace, typ string, labels, values map[string]string, stringData bool) *Secret {
+	s := &Secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   Metadata{Name: name, Namespace: namespace},
+		Type:       typ,
+	}
+
+	if len(labels) > 0 {
+		s.Metadata.Labels = labels
+	}
+
+	if stringData {
+		s.StringData = values
+		return s
+	}
+
+	s.Data = map[string]string{}
+	for k, v := range values {
+		s.Data[k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+
+	return s
+}
@@ -0,0 +1,270 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	kmsapi "k8s.io/kms/apis/v2"
+	"k8s.io/kms/pkg/service"
+
+	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	listenFlag         string
+	timeoutFlag        time.Duration
+	identityFlags      []string
+	recipientFlags     []string
+	recipientFileFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var KMSPluginCmd = cobra.Command{
+	Use:   "kms-plugin --listen SOCKET -i IDENTITY (-r RECIPIENT | -R PATH)...",
+	Short: "Run a Kubernetes KMS v2 plugin encrypting with age",
+	Long: `Run a Kubernetes KMS v2 plugin encrypting with age.
+
+The data encryption keys sent by the API server are encrypted to the given
+recipients and decrypted with the given identities. The key ID reported to the
+API server is derived from the recipients so that changing them triggers the
+re-encryption of the data encryption keys.`,
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	KMSPluginCmd.PersistentFlags().StringVar(&listenFlag, "listen", "/var/run/kmsplugin/yage.sock", "Unix `SOCKET` to listen on")
+	KMSPluginCmd.PersistentFlags().DurationVar(&timeoutFlag, "timeout", 10*time.Second, "Connection timeout")
+	KMSPluginCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	KMSPluginCmd.PersistentFlags().StringArrayVarP(&recipientFlags, "recipient", "r", []string{}, "Encrypt to the specified RECIPIENT")
+	KMSPluginCmd.PersistentFlags().StringArrayVarP(&recipientFileFlags, "recipient-file", "R", []string{}, "Encrypt to recipients listed at PATH")
+
+	if err := KMSPluginCmd.MarkPersistentFlagRequired("identity"); err != nil {
+		panic(err)
+	}
+	for _, f := range []string{"identity", "recipient-file", "listen"} {
+		if err := cobra.MarkFlagFilename(KMSPluginCmd.PersistentFlags(), f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func Run(_ *cobra.Command, _ []string) error {
+	log.SetFlags(log.LstdFlags)
+
+	keys := append([]string{}, recipientFlags...)
+	for _, name := range recipientFileFlags {
+		lines, err := utils.ReadRecipientLines(name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, lines...)
+	}
+
+	var identities []age.Identity
+	for _, name := range identityFlags {
+		ids, err := utils.ParseIdentitiesFile(name, true)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %w", name, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	plugin, err := NewPlugin(identities, keys)
+	if err != nil {
+		return err
+	}
+
+	// Fail early rather than on the first request of the API server.
+	if status, err := plugin.Status(context.Background()); err != nil {
+		return err
+	} else if status.Healthz != "ok" {
+		return errors.New(status.Healthz)
+	}
+
+	ln, err := utils.ListenUnix(listenFlag)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), utils.StopSignals...)
+	defer stop()
+
+	log.Printf("yage: kms-plugin listening on %s with key ID %s", listenFlag, plugin.KeyID())
+
+	return plugin.Serve(ctx, ln, timeoutFlag)
+}
+
+// KeyID returns the key ID of the recipients keys: a hash of the sorted set
+// of recipients.
+func KeyID(keys []string) string {
+	set := map[string]bool{}
+	for _, k := range keys {
+		set[strings.TrimSpace(k)] = true
+	}
+
+	sorted := make([]string, 0, len(set))
+	for k := range set {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+
+	return "age-" + hex.EncodeToString(sum[:16])
+}
+
+// MaxCiphertextSize is the size ciphertexts must be smaller than.
+const MaxCiphertextSize = 1024
+
+// Plugin implements the Kubernetes KMS v2 service with age.
+type Plugin struct {
+	identities []age.Identity
+	recipients []age.Recipient
+	keyID      string
+}
+
+var _ service.Service = (*Plugin)(nil)
+
+// NewPlugin returns a plugin decrypting with identities and encrypting to
+// the recipients keys.
+func NewPlugin(identities []age.Identity, keys []string) (*Plugin, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("missing identities")
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("missing recipients")
+	}
+
+	recipients, err := encrypt.Recipients(keys, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Plugin{
+		identities: identities,
+		recipients: recipients,
+		keyID:      KeyID(keys),
+	}, nil
+}
+
+// KeyID returns the key ID reported to the API server.
+func (p *Plugin) KeyID() string {
+	return p.keyID
+}
+
+// Serve serves the KMS v2 gRPC API on ln until ctx is done.
+func (p *Plugin) Serve(ctx context.Context, ln net.Listener, timeout time.Duration) error {
+	server := grpc.NewServer(grpc.ConnectionTimeout(timeout))
+	kmsapi.RegisterKeyManagementServiceServer(server, service.NewGRPCService("", timeout, p))
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.GracefulStop()
+		case <-done:
+		}
+	}()
+
+	if err := server.Serve(ln); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// Encrypt encrypts data to the recipients of the plugin.
+func (p *Plugin) Encrypt(_ context.Context, _ string, data []byte) (*service.EncryptResponse, error) {
+	buf := &bytes.Buffer{}
+
+	w, err := age.Encrypt(buf, p.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= MaxCiphertextSize {
+		return nil, fmt.Errorf("ciphertext of %d bytes exceeds the KMS limit of %d bytes, use fewer or smaller recipients", buf.Len(), MaxCiphertextSize)
+	}
+
+	return &service.EncryptResponse{
+		Ciphertext: buf.Bytes(),
+		KeyID:      p.keyID,
+	}, nil
+}
+
+// Decrypt decrypts the request ciphertext with the identities of the plugin.
+func (p *Plugin) Decrypt(_ context.Context, _ string, req *service.DecryptRequest) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(req.Ciphertext), p.identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+// Status reports the plugin healthy if it can decrypt what it encrypts.
+func (p *Plugin) Status(ctx context.Context) (*service.StatusResponse, error) {
+	status := &service.StatusResponse{
+		Version: "v2",
+		Healthz: "ok",
+		KeyID:   p.keyID,
+	}
+
+	probe := make([]byte, 32)
+	if _, err := rand.Read(probe); err != nil {
+		return nil, err
+	}
+
+	res, err := p.Encrypt(ctx, "", probe)
+	if err != nil {
+		status.Healthz = err.Error()
+		return status, nil
+	}
+
+	plaintext, err := p.Decrypt(ctx, "", &service.DecryptRequest{Ciphertext: res.Ciphertext, KeyID: res.KeyID})
+	if err != nil {
+		status.Healthz = fmt.Sprintf("identities can't decrypt: %v", err)
+	} else if !bytes.Equal(plaintext, probe) {
+		status.Healthz = "decrypted data does not match"
+	}
+
+	return status, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package ls
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	jsonFlag bool
+
+	//go:embed examples.txt
+	examples string
+)
+
+var LsCmd = cobra.Command{
+	Use:          "ls [FILE...]",
+	Aliases:      []string{"list"},
+	Short:        "List encrypted values of YAML files without decrypting them",
+	GroupID:      "age",
+	SilenceUsage: true,
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	LsCmd.PersistentFlags().BoolVar(&jsonFlag, "json", false, "Output as JSON")
+}
+
+// Entry describes a !crypto/age tagged value.
+type Entry struct {
+	File       string        `json:"file"`
+	Document   int           `json:"document"`
+	Path       string        `json:"path"`
+	Tag        string        `json:"tag"`
+	Attributes []string      `json:"attributes,omitempty"`
+	Encrypted  bool          `json:"encrypted"`
+	Header     *utils.Header `json:"header,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	entries := []Entry{}
+	for _, name := range args {
+		e, err := listFile(name)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e...)
+	}
+
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	return WriteTable(os.Stdout, entries)
+}
+
+// listFile lists the file name, or standard input if name is "-".
+func listFile(name string) ([]Entry, error) {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open input file %q: %w", name, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	e, err := List(name, in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return e, nil
+}
+
+// List returns an entry for every !crypto/age tagged value found in the YAML
+// documents read from in. Only the age headers are parsed.
+func List(name string, in io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	decoder := yaml.NewDecoder(in)
+	for doc := 0; ; doc++ {
+		node := yaml.Node{}
+		if err := decoder.Decode(&node); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("yaml decoding failed: %w", err)
+		}
+
+		err := utils.Walk(&node, func(path utils.Path, n *yaml.Node) error {
+			attrs, ok := utils.ParseAgeTag(n.Tag)
+			if !ok || n.Kind != yaml.ScalarNode {
+				return nil
+			}
+
+			e := Entry{
+				File:       name,
+				Document:   doc,
+				Path:       path.String(),
+				Tag:        n.Tag,
+				Attributes: attrs,
+			}
+
+			if utils.IsAgeArmored(n.Value) {
+				e.Encrypted = true
+				if h, err := utils.ParseHeader(strings.NewReader(n.Value)); err != nil {
+					e.Error = err.Error()
+				} else {
+					e.Header = h
+				}
+			}
+
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func WriteTable(out io.Writer, entries []Entry) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tDOC\tPATH\tATTRIBUTES\tRECIPIENTS\tSTANZAS\tSIZE")
+
+	for _, e := range entries {
+		recipients, stanzas, size := "-", "plaintext", "-"
+		switch {
+		case e.Error != "":
+			stanzas = "error: " + e.Error
+		case e.Header != nil:
+			var types []string
+			for _, s := range e.Header.Stanzas {
+				types = append(types, s.String())
+			}
+			recipients = strconv.Itoa(len(e.Header.Stanzas))
+			stanzas = strings.Join(types, ",")
+			size = strconv.Itoa(e.Header.PayloadSize)
+		}
+
+		attrs := strings.Join(e.Attributes, ",")
+		if attrs == "" {
+			attrs = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", e.File, e.Document, e.Path, attrs, recipients, stanzas, size)
+	}
+
+	return w.Flush()
+}
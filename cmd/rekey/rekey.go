@@ -164,7 +164,7 @@ func Run(_ *cobra.Command, args []string) error {
 
 	outbuf := &bytes.Buffer{}
 	if yamlFlag {
-		if err := decrypt.DecryptYAML(identityFlags, in, outbuf, stdinInUse, false, true); err != nil {
+		if err := decrypt.DecryptYAML(identityFlags, in, outbuf, stdinInUse, false, true, ""); err != nil {
 			return err
 		}
 	} else {
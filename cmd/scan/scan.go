@@ -0,0 +1,402 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/git"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	identityFlags  []string
+	jsonFlag       bool
+	noHistoryFlag  bool
+	noWorktreeFlag bool
+	minLengthFlag  int
+
+	//go:embed examples.txt
+	examples string
+)
+
+var ScanCmd = cobra.Command{
+	Use:          "scan FILE...",
+	Short:        "Search the git repository for leaked plaintexts of encrypted values",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.MinimumNArgs(1),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	ScanCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+	ScanCmd.PersistentFlags().BoolVar(&jsonFlag, "json", false, "Output as JSON")
+	ScanCmd.PersistentFlags().BoolVar(&noHistoryFlag, "no-history", false, "Do not scan the git history")
+	ScanCmd.PersistentFlags().BoolVar(&noWorktreeFlag, "no-worktree", false, "Do not scan the working tree")
+	ScanCmd.PersistentFlags().IntVar(&minLengthFlag, "min-length", 6, "Ignore values shorter than this to avoid meaningless hits")
+
+	if err := cobra.MarkFlagFilename(ScanCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+// Secret is a decrypted value to search for.
+type Secret struct {
+	File  string
+	Path  string
+	Value string
+}
+
+// Hit describes where an encoding of a secret was found. It never holds the
+// secret itself.
+type Hit struct {
+	Source     string `json:"source"`
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	SecretFile string `json:"secret_file"`
+	SecretPath string `json:"secret_path"`
+	Encoding   string `json:"encoding"`
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	identities, err := decrypt.Identities(identityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	var secrets []Secret
+	for _, name := range args {
+		s, err := Secrets(identities, name)
+		if err != nil {
+			return err
+		}
+		for _, secret := range s {
+			if len(secret.Value) < minLengthFlag {
+				log.Printf("yage: %s %s: value too short to be searched for", secret.File, secret.Path)
+				continue
+			}
+			secrets = append(secrets, secret)
+		}
+	}
+
+	hits := []Hit{}
+	if !noWorktreeFlag {
+		h, err := ScanWorktree(secrets)
+		if err != nil {
+			return err
+		}
+		hits = append(hits, h...)
+	}
+	if !noHistoryFlag {
+		h, err := ScanHistory(secrets)
+		if err != nil {
+			return err
+		}
+		hits = append(hits, h...)
+	}
+
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(hits); err != nil {
+			return err
+		}
+	} else if err := WriteTable(os.Stdout, hits); err != nil {
+		return err
+	}
+
+	if len(hits) > 0 {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// Secrets returns the scalar values of the file name which are tagged with
+// !crypto/age, decrypted with identities, in the order they are defined.
+func Secrets(identities []age.Identity, name string) ([]Secret, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	docs, err := decrypt.DecryptDocuments(identities, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var secrets []Secret
+	for i, doc := range docs {
+		prefix := ""
+		if len(docs) > 1 {
+			prefix = "#" + strconv.Itoa(i)
+		}
+
+		// Aliases and merge keys are not followed, so each value is found
+		// once, at the path where it is defined.
+		seen := map[*yaml.Node]bool{}
+		_ = utils.Walk(doc.Node, func(p utils.Path, n *yaml.Node) error {
+			if n.Kind == yaml.ScalarNode && doc.Secrets[p.String()] && !seen[n] {
+				seen[n] = true
+				secrets = append(secrets, Secret{File: name, Path: prefix + p.String(), Value: n.Value})
+			}
+			return nil
+		})
+	}
+
+	return secrets, nil
+}
+
+type needle struct {
+	secret   *Secret
+	encoding string
+	data     []byte
+}
+
+// needles returns the encodings of secrets worth searching for.
+func needles(secrets []Secret) []needle {
+	var ns []needle
+
+	for i := range secrets {
+		s := &secrets[i]
+		v := []byte(s.Value)
+
+		seen := map[string]bool{}
+		for _, e := range []struct{ name, data string }{
+			{"plain", s.Value},
+			{"base64", base64.StdEncoding.EncodeToString(v)},
+			{"base64", base64.RawStdEncoding.EncodeToString(v)},
+			{"base64url", base64.URLEncoding.EncodeToString(v)},
+			{"base64url", base64.RawURLEncoding.EncodeToString(v)},
+			{"hex", hex.EncodeToString(v)},
+			{"url", url.QueryEscape(s.Value)},
+		} {
+			if seen[e.data] {
+				continue
+			}
+			seen[e.data] = true
+			ns = append(ns, needle{secret: s, encoding: e.name, data: []byte(e.data)})
+		}
+	}
+
+	return ns
+}
+
+// search returns a hit for every needle found in content, once per secret and
+// encoding name.
+func search(ns []needle, source, file string, content []byte) []Hit {
+	var hits []Hit
+
+	reported := map[string]bool{}
+	for _, n := range ns {
+		i := bytes.Index(content, n.data)
+		if i < 0 {
+			continue
+		}
+
+		key := n.secret.File + "\x00" + n.secret.Path + "\x00" + n.encoding
+		if reported[key] {
+			continue
+		}
+		reported[key] = true
+
+		hits = append(hits, Hit{
+			Source:     source,
+			File:       file,
+			Line:       bytes.Count(content[:i], []byte("\n")) + 1,
+			SecretFile: n.secret.File,
+			SecretPath: n.secret.Path,
+			Encoding:   n.encoding,
+		})
+	}
+
+	return hits
+}
+
+// ScanWorktree searches the files of the working tree which are not ignored
+// by git for secrets.
+func ScanWorktree(secrets []Secret) ([]Hit, error) {
+	top, err := git.Git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimSpace(string(top))
+
+	out, err := git.Git("-C", root, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+
+	ns := needles(secrets)
+
+	var hits []Hit
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil || !fi.Mode().IsRegular() {
+			// Deleted or not a regular file.
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+
+		hits = append(hits, search(ns, "worktree", name, content)...)
+	}
+
+	return hits, nil
+}
+
+// ScanHistory searches every blob reachable from any git reference for
+// secrets, and reports hits for every commit adding or removing the blob.
+func ScanHistory(secrets []Secret) ([]Hit, error) {
+	out, err := git.Git("rev-list", "--all", "--objects")
+	if err != nil {
+		return nil, err
+	}
+
+	// Only objects listed with a path are blobs or trees.
+	paths := map[string]string{}
+	var ids []string
+	for _, line := range strings.Split(string(out), "\n") {
+		id, path, ok := strings.Cut(line, " ")
+		if !ok || path == "" {
+			continue
+		}
+		if _, seen := paths[id]; !seen {
+			paths[id] = path
+			ids = append(ids, id)
+		}
+	}
+
+	ns := needles(secrets)
+
+	var hits []Hit
+	err = catFile(ids, func(id, kind string, content []byte) error {
+		if kind != "blob" {
+			return nil
+		}
+
+		found := search(ns, "", paths[id], content)
+		if len(found) == 0 {
+			return nil
+		}
+
+		commits, err := git.Git("log", "--all", "--format=%H", "--find-object="+id)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range strings.Fields(string(commits)) {
+			for _, h := range found {
+				h.Source = c
+				hits = append(hits, h)
+			}
+		}
+
+		return nil
+	})
+
+	return hits, err
+}
+
+// catFile calls fn with the type and content of every object of ids.
+func catFile(ids []string, fn func(id, kind string, content []byte) error) error {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Stderr = stderr
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// stop kills git cat-file once it is no longer read from, and waits for
+	// it so that stderr is complete.
+	stop := func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+
+	r := bufio.NewReader(stdout)
+	for range ids {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			stop()
+			return fmt.Errorf("git cat-file: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			// Missing object.
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			stop()
+			return fmt.Errorf("git cat-file: unexpected header %q", header)
+		}
+
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(r, content); err != nil {
+			stop()
+			return fmt.Errorf("git cat-file: %w", err)
+		}
+
+		if err := fn(fields[0], fields[1], content[:size]); err != nil {
+			stop()
+			return err
+		}
+	}
+
+	return cmd.Wait()
+}
+
+// WriteTable writes hits as an aligned table.
+func WriteTable(out io.Writer, hits []Hit) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tFILE\tLINE\tSECRET\tENCODING")
+	for _, h := range hits {
+		fmt.Fprintf(tw, "%.12s\t%s\t%d\t%s %s\t%s\n", h.Source, h.File, h.Line, h.SecretFile, h.SecretPath, h.Encoding)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,534 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package serve
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+// TokenEnv names the variable holding the bearer token when --token-file is
+// not given.
+const TokenEnv = "YAGE_SERVE_TOKEN"
+
+var (
+	listenFlag    string
+	fileFlags     []string
+	allowFlags    []string
+	allowUIDFlags []int
+	tokenFileFlag string
+	identityFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var ServeCmd = cobra.Command{
+	Use:   "serve --listen ADDRESS -f NAME=FILE... --allow NAME/PATH...",
+	Short: "Serve decrypted values over HTTP",
+	Long: `Serve decrypted values over HTTP.
+
+Values are served at /v1/secrets/NAME/PATH where PATH is either a yage path,
+like .db.password, or keys separated by slashes, like db/password. Scalars are
+served as text, other values as JSON. Only the values at or below the allowed
+paths are served. Files are decrypted again when they change.
+
+The server listens on a unix socket, given as unix:PATH, or on a loopback
+address. Clients must send the bearer token read from --token-file or
+` + TokenEnv + ` if set, which is required on loopback addresses. On unix
+sockets, clients must also run as one of the allowed uids, by default the uid
+of the server.`,
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	ServeCmd.PersistentFlags().StringVar(&listenFlag, "listen", "", "Listen on `ADDRESS`, unix:PATH or HOST:PORT on a loopback interface")
+	ServeCmd.PersistentFlags().StringArrayVarP(&fileFlags, "file", "f", []string{}, "Serve the values of FILE as `NAME=FILE`, or FILE named after its base name without extensions")
+	ServeCmd.PersistentFlags().StringArrayVar(&allowFlags, "allow", []string{}, "Allow serving the values at or below `NAME/PATH`")
+	ServeCmd.PersistentFlags().IntSliceVar(&allowUIDFlags, "allow-uid", []int{}, "Allow clients running as `UID` on unix sockets (default the uid of the server)")
+	ServeCmd.PersistentFlags().StringVar(&tokenFileFlag, "token-file", "", "Require the bearer token read from `FILE`")
+	ServeCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	for _, f := range []string{"listen", "file", "allow"} {
+		if err := ServeCmd.MarkPersistentFlagRequired(f); err != nil {
+			panic(err)
+		}
+	}
+	for _, f := range []string{"file", "token-file", "identity"} {
+		if err := cobra.MarkFlagFilename(ServeCmd.PersistentFlags(), f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func Run(_ *cobra.Command, _ []string) error {
+	log.SetFlags(log.LstdFlags)
+
+	files := map[string]string{}
+	for _, f := range fileFlags {
+		name, file, ok := strings.Cut(f, "=")
+		if !ok {
+			name, _, _ = strings.Cut(filepath.Base(f), ".")
+			file = f
+		}
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		if _, ok := files[name]; ok {
+			return fmt.Errorf("file name %q given twice", name)
+		}
+		files[name] = file
+	}
+
+	token := os.Getenv(TokenEnv)
+	if tokenFileFlag != "" {
+		b, err := os.ReadFile(tokenFileFlag)
+		if err != nil {
+			return fmt.Errorf("failed to read token file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	var ln net.Listener
+	var err error
+	if socket, ok := strings.CutPrefix(listenFlag, "unix:"); ok {
+		if _, err := utils.PeerUID(nil); errors.Is(err, utils.ErrPeerCredentialsUnsupported) && token == "" {
+			return fmt.Errorf("%w, a token is required", err)
+		}
+		if ln, err = utils.ListenUnix(socket); err != nil {
+			return err
+		}
+	} else {
+		if token == "" {
+			return fmt.Errorf("a token is required when listening on %s", listenFlag)
+		}
+		if err := checkLoopback(listenFlag); err != nil {
+			return err
+		}
+		if ln, err = net.Listen("tcp", listenFlag); err != nil {
+			return err
+		}
+	}
+
+	identities, err := decrypt.Identities(identityFlags, false)
+	if err != nil {
+		return err
+	}
+
+	uids := allowUIDFlags
+	if len(uids) == 0 {
+		uids = []int{os.Getuid()}
+	}
+
+	server, err := NewServer(identities, files, allowFlags, token, uids)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), utils.StopSignals...)
+	defer stop()
+
+	log.Printf("yage: serving on %s", ln.Addr())
+
+	return server.Serve(ctx, ln)
+}
+
+// checkLoopback checks that address is on a loopback interface.
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("refusing to listen on %s which is not a loopback address", address)
+	}
+	return nil
+}
+
+// Server serves the decrypted values of YAML files.
+type Server struct {
+	identities []age.Identity
+	sources    map[string]*source
+	allowed    map[string][]utils.Path
+	token      string
+	uids       map[int]bool
+}
+
+// NewServer returns a server serving the values of files, indexed by name,
+// which are at or below the allowed paths, written NAME/PATH. Clients must
+// send token if not empty. Clients connected on unix sockets must run as one
+// of uids. Files are decrypted once so that errors are reported early.
+func NewServer(identities []age.Identity, files map[string]string, allow []string, token string, uids []int) (*Server, error) {
+	s := &Server{
+		identities: identities,
+		sources:    map[string]*source{},
+		allowed:    map[string][]utils.Path{},
+		token:      token,
+		uids:       map[int]bool{},
+	}
+
+	for name, file := range files {
+		src := &source{file: file}
+		if _, err := src.get(identities); err != nil {
+			return nil, err
+		}
+		s.sources[name] = src
+	}
+
+	for _, a := range allow {
+		name, p, _ := strings.Cut(a, "/")
+		if _, ok := s.sources[name]; !ok {
+			return nil, fmt.Errorf("--allow %q: unknown file %q", a, name)
+		}
+		path, err := ParseURLPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("--allow %q: %w", a, err)
+		}
+		s.allowed[name] = append(s.allowed[name], path)
+	}
+
+	for _, uid := range uids {
+		s.uids[uid] = true
+	}
+
+	return s, nil
+}
+
+type connKey struct{}
+
+// Serve serves HTTP requests on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	server := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the value at /v1/secrets/NAME/PATH.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.authorize(r); err != nil {
+		log.Printf("yage: %s %s: %v", r.Method, r.URL.Path, err)
+		if s.token != "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1/secrets/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	name, p, _ := strings.Cut(rest, "/")
+
+	src, ok := s.sources[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	path, err := ParseURLPath(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.isAllowed(name, path) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	doc, err := src.get(s.identities)
+	if err != nil {
+		log.Printf("yage: %v", err)
+		http.Error(w, "failed to decrypt", http.StatusInternalServerError)
+		return
+	}
+
+	node, err := utils.Lookup(doc, path)
+	if errors.Is(err, utils.ErrPathNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Values reached through aliases, or holding aliases, must be allowed
+	// where they are defined.
+	anchors := anchorPaths(doc)
+	if def, ok := definedAt(doc, path, anchors); !ok || !s.isAllowed(name, def) || !s.aliasesAllowed(name, node, anchors, map[*yaml.Node]bool{}) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if node.Kind == yaml.ScalarNode {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(node.Value))
+		return
+	}
+
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// authorize checks the token and, on unix sockets, the uid of the client.
+func (s *Server) authorize(r *http.Request) error {
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok && conn.LocalAddr().Network() == "unix" {
+		uid, err := utils.PeerUID(conn)
+		if err != nil && !(errors.Is(err, utils.ErrPeerCredentialsUnsupported) && s.token != "") {
+			return err
+		} else if err == nil && !s.uids[uid] {
+			return fmt.Errorf("uid %d is not allowed", uid)
+		}
+	}
+
+	if s.token == "" {
+		return nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return errors.New("invalid token")
+	}
+
+	return nil
+}
+
+// isAllowed reports whether path of the file name is at or below one of the
+// allowed paths.
+func (s *Server) isAllowed(name string, path utils.Path) bool {
+	for _, a := range s.allowed[name] {
+		if path.HasPrefix(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// aliasesAllowed reports whether the aliases below node, merge keys included,
+// point to allowed values.
+func (s *Server) aliasesAllowed(name string, node *yaml.Node, anchors map[string][]utils.Path, seen map[*yaml.Node]bool) bool {
+	if node == nil || seen[node] {
+		return true
+	}
+	seen[node] = true
+
+	if node.Kind == yaml.AliasNode {
+		paths := anchors[node.Value]
+		if len(paths) == 0 {
+			return false
+		}
+		for _, p := range paths {
+			if !s.isAllowed(name, p) {
+				return false
+			}
+		}
+		return s.aliasesAllowed(name, node.Alias, anchors, seen)
+	}
+
+	for _, c := range node.Content {
+		if !s.aliasesAllowed(name, c, anchors, seen) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// anchorPaths returns the paths of the anchored values of doc by anchor.
+func anchorPaths(doc *yaml.Node) map[string][]utils.Path {
+	anchors := map[string][]utils.Path{}
+	_ = utils.Walk(doc, func(p utils.Path, n *yaml.Node) error {
+		if n.Anchor != "" {
+			anchors[n.Anchor] = append(anchors[n.Anchor], p)
+		}
+		return nil
+	})
+	return anchors
+}
+
+// definedAt returns the path where the value at path of doc is defined, which
+// differs from path when it is reached through aliases. It reports false if
+// there is no such value or an alias is ambiguous.
+func definedAt(doc *yaml.Node, path utils.Path, anchors map[string][]utils.Path) (utils.Path, bool) {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	var def utils.Path
+	for _, e := range path {
+		var next *yaml.Node
+		switch {
+		case e.IsIndex && node.Kind == yaml.SequenceNode:
+			if e.Index < len(node.Content) {
+				next = node.Content[e.Index]
+			}
+		case !e.IsIndex && node.Kind == yaml.MappingNode:
+			_, next = utils.MappingEntry(node, e.Key)
+		}
+		if next == nil {
+			return nil, false
+		}
+
+		def = def.Child(e)
+		for next.Kind == yaml.AliasNode {
+			paths := anchors[next.Value]
+			if len(paths) != 1 || next.Alias == nil {
+				return nil, false
+			}
+			def, next = paths[0], next.Alias
+		}
+		node = next
+	}
+
+	return def, true
+}
+
+// ParseURLPath parses p, either a yage path or keys separated by slashes.
+// Numeric keys are indexes.
+func ParseURLPath(p string) (utils.Path, error) {
+	if p == "" || strings.HasPrefix(p, ".") || strings.HasPrefix(p, "[") {
+		return utils.ParsePath(p)
+	}
+
+	var path utils.Path
+	for _, k := range strings.Split(strings.Trim(p, "/"), "/") {
+		if i, err := strconv.Atoi(k); err == nil && i >= 0 {
+			path = append(path, utils.PathElem{Index: i, IsIndex: true})
+		} else {
+			path = append(path, utils.PathElem{Key: k})
+		}
+	}
+
+	return path, nil
+}
+
+// source is a YAML file decrypted again when its size or modification time
+// change.
+type source struct {
+	file string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	doc     *yaml.Node
+}
+
+// get returns the decrypted document of the file. The last decrypted
+// document is returned if the file can't be decrypted anymore.
+func (s *source) get(identities []age.Identity) (*yaml.Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		if s.doc != nil {
+			log.Printf("yage: %s: %v, serving the last values", s.file, err)
+			return s.doc, nil
+		}
+		return nil, err
+	}
+
+	if s.doc != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.doc, nil
+	}
+
+	doc, err := s.load(identities)
+	if err != nil {
+		if s.doc != nil {
+			log.Printf("yage: %v, serving the last values", err)
+			return s.doc, nil
+		}
+		return nil, err
+	}
+
+	if s.doc != nil {
+		log.Printf("yage: %s reloaded", s.file)
+	}
+	s.doc, s.modTime, s.size = doc, info.ModTime(), info.Size()
+
+	return s.doc, nil
+}
+
+func (s *source) load(identities []age.Identity) (*yaml.Node, error) {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file %q: %w", s.file, err)
+	}
+	defer f.Close()
+
+	docs, err := decrypt.DecryptDocuments(identities, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.file, err)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("%s: no YAML document found", s.file)
+	}
+
+	return docs[0].Node, nil
+}
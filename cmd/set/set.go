@@ -0,0 +1,247 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package set
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	outFlag            string
+	valueFlag          string
+	valueFileFlag      string
+	valueStdinFlag     bool
+	attributesFlag     []string
+	recipientFlags     []string
+	recipientFileFlags []string
+	identityFlags      []string
+
+	//go:embed examples.txt
+	examples string
+	//go:embed unset_examples.txt
+	unsetExamples string
+)
+
+var SetCmd = cobra.Command{
+	Use:               "set FILE PATH",
+	Short:             "Encrypt a single value of a YAML file in place",
+	GroupID:           "age",
+	SilenceUsage:      true,
+	Args:              cobra.ExactArgs(2),
+	PersistentPreRunE: Validate,
+	RunE:              Run,
+	Example:           examples,
+}
+
+var UnsetCmd = cobra.Command{
+	Use:          "unset FILE PATH",
+	Short:        "Remove a single value of a YAML file in place",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	RunE:         RunUnset,
+	Example:      unsetExamples,
+}
+
+func init() {
+	SetCmd.PersistentFlags().StringVarP(&outFlag, "output", "o", "", "Output to `FILE` instead of editing the input file")
+	SetCmd.PersistentFlags().StringVar(&valueFlag, "value", "", "Value to encrypt")
+	SetCmd.PersistentFlags().StringVar(&valueFileFlag, "value-file", "", "Read the value to encrypt from `FILE`")
+	SetCmd.PersistentFlags().BoolVar(&valueStdinFlag, "value-from-stdin", false, "Read the value to encrypt from stdin (a trailing newline is stripped)")
+	SetCmd.PersistentFlags().StringSliceVar(&attributesFlag, "attributes", []string{}, "Tag attributes (e.g. DoubleQuoted,NoTag)")
+	SetCmd.PersistentFlags().StringArrayVarP(&recipientFlags, "recipient", "r", []string{}, "Recipient public key")
+	SetCmd.PersistentFlags().StringArrayVarP(&recipientFileFlags, "recipient-file", "R", []string{}, "Recipient public key file")
+	SetCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key (used to derive public key which will be added as recipient)")
+
+	UnsetCmd.PersistentFlags().StringVarP(&outFlag, "output", "o", "", "Output to `FILE` instead of editing the input file")
+
+	if err := cobra.MarkFlagFilename(SetCmd.PersistentFlags(), "recipient-file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(SetCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(SetCmd.PersistentFlags(), "value-file"); err != nil {
+		panic(err)
+	}
+}
+
+func Validate(cmd *cobra.Command, _ []string) error {
+	if len(recipientFlags)+len(recipientFileFlags)+len(identityFlags) == 0 {
+		return fmt.Errorf("missing recipients.\n" +
+			"Did you forget to specify -r/--recipient or -R/--recipient-file?")
+	}
+
+	sources := 0
+	for _, set := range []bool{cmd.Flags().Changed("value"), valueFileFlag != "", valueStdinFlag} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("--value, --value-file and --value-from-stdin are mutually exclusive.")
+	}
+
+	for _, attr := range attributesFlag {
+		if !utils.IsTagAttribute(attr) {
+			return fmt.Errorf("unknown tag attribute %q.", attr)
+		}
+	}
+
+	return nil
+}
+
+func Run(cmd *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	inputName := args[0]
+	stdinInUse := inputName == "-"
+
+	path, err := utils.ParsePath(args[1])
+	if err != nil {
+		return err
+	}
+
+	src, err := readInput(inputName)
+	if err != nil {
+		return err
+	}
+
+	var value string
+	switch {
+	case cmd.Flags().Changed("value"):
+		value = valueFlag
+	case valueFileFlag != "":
+		b, err := os.ReadFile(valueFileFlag)
+		if err != nil {
+			return fmt.Errorf("failed to read value file %q: %w", valueFileFlag, err)
+		}
+		value = string(b)
+	case valueStdinFlag:
+		if stdinInUse {
+			return fmt.Errorf("standard input is used for multiple purposes")
+		}
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read value from stdin: %w", err)
+		}
+		value = strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+		stdinInUse = true
+	default:
+		b, err := utils.ReadPassphrase(fmt.Sprintf("Enter value for %s:", path))
+		if err != nil {
+			return fmt.Errorf("could not read value: %w", err)
+		}
+		value = string(b)
+	}
+
+	recipients, err := encrypt.Recipients(recipientFlags, recipientFileFlags, identityFlags, stdinInUse)
+	if err != nil {
+		return err
+	}
+
+	out, err := Set(recipients, src, path, value, attributesFlag)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(inputName, out)
+}
+
+func RunUnset(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	path, err := utils.ParsePath(args[1])
+	if err != nil {
+		return err
+	}
+
+	src, err := readInput(args[0])
+	if err != nil {
+		return err
+	}
+
+	out, err := utils.DeleteYAMLValue(src, path)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(args[0], out)
+}
+
+// Set returns src with the value at path replaced by value encrypted to
+// recipients. The tag of an existing !crypto/age value is kept unless
+// attributes are given. Other nodes are left untouched.
+func Set(recipients []age.Recipient, src []byte, path utils.Path, value string, attributes []string) ([]byte, error) {
+	tag := utils.AgeTag
+	if len(attributes) > 0 {
+		tag += ":" + strings.Join(attributes, ",")
+	} else {
+		doc := yaml.Node{}
+		if err := yaml.Unmarshal(src, &doc); err == nil && doc.Kind == yaml.DocumentNode {
+			if node, err := utils.Lookup(&doc, path); err == nil {
+				if _, ok := utils.ParseAgeTag(node.Tag); ok {
+					tag = node.Tag
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encrypt.Encrypt(recipients, strings.NewReader(value), buf, true); err != nil {
+		return nil, err
+	}
+
+	return utils.SetYAMLValue(src, path, tag, strings.TrimSuffix(buf.String(), "\n"))
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file %q: %w", name, err)
+	}
+
+	return src, nil
+}
+
+func writeOutput(inputName string, out []byte) error {
+	switch {
+	case outFlag != "" && outFlag != "-":
+		if _, err := os.Stat(outFlag); err == nil {
+			return fmt.Errorf("output file %q exists", outFlag)
+		}
+		f := utils.NewLazyOpener(outFlag, false)
+		if _, err := f.Write(out); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case outFlag == "-" || inputName == "-":
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+
+	return utils.WriteFileAtomic(inputName, out, 0o660)
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package template
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/utils"
+)
+
+var (
+	fileFlag      string
+	outFlag       string
+	identityFlags []string
+
+	//go:embed examples.txt
+	examples string
+)
+
+var TemplateCmd = cobra.Command{
+	Use:          "template -f FILE [TEMPLATE]",
+	Aliases:      []string{"tpl"},
+	Short:        "Render a Go template with decrypted values",
+	GroupID:      "age",
+	SilenceUsage: true,
+	Args:         cobra.MaximumNArgs(1),
+	RunE:         Run,
+	Example:      examples,
+}
+
+func init() {
+	TemplateCmd.PersistentFlags().StringVarP(&fileFlag, "file", "f", "", "YAML file holding the template data")
+	TemplateCmd.PersistentFlags().StringVarP(&outFlag, "output", "o", "", "Output to `FILE` (default stdout), which must not exist")
+	TemplateCmd.PersistentFlags().StringArrayVarP(&identityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	if err := TemplateCmd.MarkPersistentFlagRequired("file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(TemplateCmd.PersistentFlags(), "file"); err != nil {
+		panic(err)
+	}
+	if err := cobra.MarkFlagFilename(TemplateCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func Run(_ *cobra.Command, args []string) error {
+	log.SetFlags(0)
+
+	name := "-"
+	if len(args) > 0 {
+		name = args[0]
+	}
+
+	var text []byte
+	var err error
+	if name == "-" {
+		text, err = io.ReadAll(os.Stdin)
+	} else {
+		text, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read template %q: %w", name, err)
+	}
+
+	if outFlag != "" && outFlag != "-" {
+		if _, err := os.Stat(outFlag); err == nil {
+			return fmt.Errorf("output file %q exists", outFlag)
+		}
+	}
+
+	f, err := os.Open(fileFlag)
+	if err != nil {
+		return fmt.Errorf("failed to open input file %q: %w", fileFlag, err)
+	}
+	defer f.Close()
+
+	identities, err := decrypt.Identities(identityFlags, name == "-")
+	if err != nil {
+		return err
+	}
+
+	docs, err := decrypt.DecryptDocuments(identities, f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileFlag, err)
+	}
+
+	var data any
+	if len(docs) > 0 {
+		if err := docs[0].Node.Decode(&data); err != nil {
+			return fmt.Errorf("%s: %w", fileFlag, err)
+		}
+	}
+
+	// Render in memory so that no partial output ends up on disk.
+	buf := &bytes.Buffer{}
+	if err := Render(buf, filepath.Base(name), string(text), data); err != nil {
+		return err
+	}
+
+	if outFlag != "" && outFlag != "-" {
+		o := utils.NewLazyOpenerPerm(outFlag, false, 0o600)
+		if _, err := buf.WriteTo(o); err != nil {
+			o.Close()
+			return err
+		}
+		return o.Close()
+	}
+
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
+
+// Render executes the template text with data and FuncMap's functions.
+func Render(out io.Writer, name, text string, data any) error {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(FuncMap()).Parse(text)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(out, data)
+}
+
+// FuncMap returns the functions available to templates.
+func FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"b64dec": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+		"quote": func(v any) string {
+			return strconv.Quote(fmt.Sprint(v))
+		},
+		"squote": func(v any) string {
+			return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+		},
+		"toYaml": func(v any) (string, error) {
+			b, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(b), "\n"), err
+		},
+		"toJson": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"indent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+		},
+		"nindent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return "\n" + pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+		},
+		"default": func(d, v any) any {
+			if v == nil || v == "" {
+				return d
+			}
+			return v
+		},
+	}
+}
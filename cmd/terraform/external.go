@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package terraform
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/get"
+	"sylr.dev/yage/v2/utils"
+	yage "sylr.dev/yaml/age/v3"
+)
+
+var (
+	externalIdentityFlags []string
+
+	//go:embed external_examples.txt
+	externalExamples string
+)
+
+var ExternalCmd = cobra.Command{
+	Use:   "external",
+	Short: "Decrypt values for the Terraform external data source",
+	Long: `Decrypt values for the Terraform external data source.
+
+The query read from stdin holds the YAML file to read in "file" and the paths
+of the values to decrypt in "keys", separated by commas or new lines. The
+values are printed as a JSON object indexed by the keys as given in the query.
+Values which are not scalars are printed as JSON.
+
+Errors are printed on a single line on stderr as Terraform expects.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Args:          cobra.NoArgs,
+	Run:           RunExternal,
+	Example:       externalExamples,
+}
+
+func init() {
+	ExternalCmd.PersistentFlags().StringArrayVarP(&externalIdentityFlags, "identity", "i", []string{}, "Identity private key for decrypting")
+
+	if err := cobra.MarkFlagFilename(ExternalCmd.PersistentFlags(), "identity"); err != nil {
+		panic(err)
+	}
+}
+
+func RunExternal(_ *cobra.Command, _ []string) {
+	log.SetFlags(0)
+
+	out, err := External(externalIdentityFlags, os.Stdin)
+	if err != nil {
+		log.Fatalf("yage: %s", strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+
+	if _, err := os.Stdout.Write(out); err != nil {
+		log.Fatalf("yage: %v", err)
+	}
+}
+
+// Query is the query of the Terraform external data source.
+type Query struct {
+	File string `json:"file"`
+	Keys string `json:"keys"`
+}
+
+// External decrypts the values requested by the JSON query read from in and
+// returns them as a JSON object of strings.
+func External(keys []string, in io.Reader) ([]byte, error) {
+	query := Query{}
+	decoder := json.NewDecoder(in)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&query); err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	if query.File == "" {
+		return nil, fmt.Errorf("invalid query: missing file")
+	}
+
+	names := strings.FieldsFunc(query.Keys, func(r rune) bool { return r == ',' || r == '\n' })
+	if len(names) == 0 {
+		return nil, fmt.Errorf("invalid query: missing keys")
+	}
+
+	content, err := os.ReadFile(query.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", query.File, err)
+	}
+
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("%s: yaml decoding failed: %w", query.File, err)
+	}
+
+	// stdin holds the query so it can't be used for passphrases.
+	identities, err := decrypt.Identities(keys, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		p := name
+		if !strings.HasPrefix(p, ".") && !strings.HasPrefix(p, "[") {
+			p = "." + p
+		}
+		path, err := utils.ParsePath(p)
+		if err != nil {
+			return nil, err
+		}
+
+		node, err := utils.Lookup(&doc, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", query.File, err)
+		}
+
+		value := yaml.Node{}
+		w := yage.Wrapper{Value: &value, Identities: identities, ForceNoTag: true}
+		if err := node.Decode(&w); err != nil {
+			return nil, fmt.Errorf("%s: %s: failed to decrypt: %w", query.File, path, err)
+		}
+
+		if value.Kind == yaml.ScalarNode {
+			result[name] = value.Value
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		if err := get.WriteNode(buf, &value, true); err != nil {
+			return nil, err
+		}
+		result[name] = strings.TrimSuffix(buf.String(), "\n")
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("json encoding failed: %w", err)
+	}
+
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2021 Google LLC
+// Copyright 2021 Sylvain Rabot
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package terraform
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var TerraformCmd = cobra.Command{
+	Use:          "terraform",
+	Aliases:      []string{"tf"},
+	Short:        "Terraform integration helpers",
+	GroupID:      "age",
+	SilenceUsage: true,
+}
+
+func init() {
+	TerraformCmd.AddCommand(&ExternalCmd)
+}
@@ -9,12 +9,33 @@ package yage
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 
+	"sylr.dev/yage/v2/cmd/agent"
+	"sylr.dev/yage/v2/cmd/check"
+	"sylr.dev/yage/v2/cmd/credentials"
+	"sylr.dev/yage/v2/cmd/csi"
 	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/diff"
 	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/cmd/exec"
+	"sylr.dev/yage/v2/cmd/get"
+	"sylr.dev/yage/v2/cmd/git"
+	"sylr.dev/yage/v2/cmd/helm"
+	"sylr.dev/yage/v2/cmd/history"
+	"sylr.dev/yage/v2/cmd/inspect"
+	"sylr.dev/yage/v2/cmd/k8s"
+	"sylr.dev/yage/v2/cmd/kms"
+	"sylr.dev/yage/v2/cmd/ls"
 	"sylr.dev/yage/v2/cmd/rekey"
+	"sylr.dev/yage/v2/cmd/scan"
+	"sylr.dev/yage/v2/cmd/serve"
+	"sylr.dev/yage/v2/cmd/set"
+	"sylr.dev/yage/v2/cmd/template"
+	"sylr.dev/yage/v2/cmd/terraform"
 )
 
 var Version string = "dev"
@@ -48,6 +69,46 @@ func init() {
 	YAGECmd.AddCommand(&decrypt.DecryptCmd)
 	YAGECmd.AddCommand(&encrypt.EncryptCmd)
 	YAGECmd.AddCommand(&rekey.RekeyCmd)
+	YAGECmd.AddCommand(&get.GetCmd)
+	YAGECmd.AddCommand(&set.SetCmd)
+	YAGECmd.AddCommand(&set.UnsetCmd)
+	YAGECmd.AddCommand(&ls.LsCmd)
+	YAGECmd.AddCommand(&inspect.InspectCmd)
+	YAGECmd.AddCommand(&diff.DiffCmd)
+	YAGECmd.AddCommand(&exec.ExecCmd)
+	YAGECmd.AddCommand(&template.TemplateCmd)
+	YAGECmd.AddCommand(&k8s.K8sCmd)
+	YAGECmd.AddCommand(&helm.HelmCmd)
+	YAGECmd.AddCommand(&terraform.TerraformCmd)
+	YAGECmd.AddCommand(&credentials.CredentialsCmd)
+	YAGECmd.AddCommand(&kms.KMSPluginCmd)
+	YAGECmd.AddCommand(&csi.CSIProviderCmd)
+	YAGECmd.AddCommand(&agent.AgentCmd)
+	YAGECmd.AddCommand(&serve.ServeCmd)
+	YAGECmd.AddCommand(&check.CheckCmd)
+	YAGECmd.AddCommand(&scan.ScanCmd)
+	YAGECmd.AddCommand(&git.GitCmd)
+	YAGECmd.AddCommand(&history.LogCmd)
+}
+
+// binaryAliases maps the names yage can be installed under to the
+// sub-commands they run, for tools which can't pass arguments.
+var binaryAliases = map[string][]string{
+	"yage-krm":               {"k8s", "krm"},
+	"yage-post-renderer":     {"helm", "post-renderer"},
+	"docker-credential-yage": {"credentials", "docker"},
+	"git-credential-yage":    {"credentials", "git"},
+}
+
+// Execute runs YAGECmd, or the sub-command matching the name yage was
+// invoked as.
+func Execute() error {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if args, ok := binaryAliases[name]; ok {
+		YAGECmd.SetArgs(append(append([]string{}, args...), os.Args[1:]...))
+	}
+
+	return YAGECmd.Execute()
 }
 
 func RunE(cmd *cobra.Command, args []string) error {
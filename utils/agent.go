@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"filippo.io/age"
+)
+
+// AgentSocketEnv names the variable holding the socket of the yage agent.
+const AgentSocketEnv = "YAGE_AGENT_SOCK"
+
+// AgentRequest is sent to the yage agent to unwrap the file key of a header.
+type AgentRequest struct {
+	Stanzas []*age.Stanza `json:"stanzas"`
+}
+
+// AgentResponse is the answer of the yage agent to an AgentRequest.
+type AgentResponse struct {
+	FileKey []byte `json:"fileKey,omitempty"`
+	// NoMatch is set when none of the identities of the agent match.
+	NoMatch bool   `json:"noMatch,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var _ age.Identity = (*AgentIdentity)(nil)
+
+// AgentIdentity unwraps file keys with the identities held by the yage agent
+// listening on Socket. It acts as a non-matching identity if the agent can't
+// be reached, so that the next identities are tried.
+type AgentIdentity struct {
+	Socket  string
+	Timeout time.Duration
+
+	warned bool
+}
+
+func (i *AgentIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	timeout := i.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn, err := net.DialTimeout("unix", i.Socket, timeout)
+	if err != nil {
+		if !i.warned {
+			Warningf("agent %s unreachable: %v", i.Socket, err)
+			i.warned = true
+		}
+		return nil, age.ErrIncorrectIdentity
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(AgentRequest{Stanzas: stanzas}); err != nil {
+		return nil, fmt.Errorf("agent: %w", err)
+	}
+
+	res := AgentResponse{}
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return nil, fmt.Errorf("agent: %w", err)
+	}
+
+	switch {
+	case res.Error != "":
+		return nil, fmt.Errorf("agent: %s", res.Error)
+	case res.NoMatch:
+		return nil, age.ErrIncorrectIdentity
+	case len(res.FileKey) == 0:
+		return nil, errors.New("agent: empty file key")
+	}
+
+	return res.FileKey, nil
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file created next to name and
+// renames it over name, so that readers never see a partially written file.
+// Symbolic links are followed, so that the file they point to is replaced
+// rather than the link itself. The mode and owner of an existing file are
+// preserved, perm is used otherwise.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(name); err == nil {
+		name = target
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	stat, err := os.Stat(name)
+	if err == nil {
+		perm = stat.Mode().Perm()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if stat != nil {
+		if err := chownAs(f, stat); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
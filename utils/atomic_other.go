@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "os"
+
+// chownAs does nothing, owners are not preserved on this platform.
+func chownAs(_ *os.File, _ os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// chownAs gives f the owner and group of the file described by info, if they
+// differ from its own.
+func chownAs(f *os.File, info os.FileInfo) error {
+	want, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if have, ok := stat.Sys().(*syscall.Stat_t); ok && have.Uid == want.Uid && have.Gid == want.Gid {
+		return nil
+	}
+
+	return f.Chown(int(want.Uid), int(want.Gid))
+}
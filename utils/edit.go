@@ -0,0 +1,784 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// YAML files are edited textually rather than decoded and re-encoded, so that
+// everything but the edited node, comments and existing ciphertexts included,
+// is preserved byte for byte. Only the first document of a stream and block
+// style collections can be edited.
+
+// SetYAMLValue returns src with the scalar found at path replaced by value,
+// tagged with tag. Missing intermediate mappings are created.
+func SetYAMLValue(src []byte, path Path, tag, value string) ([]byte, error) {
+	s, err := newYAMLSource(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("can't set the root node")
+	}
+
+	if s.root == nil {
+		if path[0].IsIndex {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:1])
+		}
+		out := append([]byte{}, src...)
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		return append(out, renderYAMLEntries(path, 0, tag, value)...), nil
+	}
+
+	steps, node, err := s.locate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(steps) == len(path) {
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s is not a scalar", path)
+		}
+		start, end, comment := s.valueSpan(steps, node)
+		text := renderYAMLScalar(node.Anchor, tag, value, s.contentIndent(steps), comment)
+		if start > 0 && src[start-1] != ' ' {
+			text = " " + text
+		}
+		return s.replace(start, end, text), nil
+	}
+
+	missing := path[len(steps):]
+	if missing[0].IsIndex {
+		return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:len(steps)+1])
+	}
+
+	switch {
+	case node.Kind == yaml.MappingNode:
+		end, indent, err := s.appendOffset(steps, node)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path[:len(steps)], err)
+		}
+		text := renderYAMLEntries(missing, indent, tag, value)
+		if end > 0 && src[end-1] != '\n' {
+			text = "\n" + text
+		}
+		return s.replace(end, end, text), nil
+
+	case node.Kind == yaml.ScalarNode && node.Tag == "!!null" && len(steps) > 0 && steps[len(steps)-1].parent.Kind == yaml.MappingNode:
+		start, end, comment := s.valueSpan(steps, node)
+		for start > 0 && s.src[start-1] == ' ' {
+			start--
+		}
+		text := ""
+		if node.Anchor != "" {
+			text += " &" + node.Anchor
+		}
+		if comment != "" {
+			text += " " + comment
+		}
+		text += "\n" + strings.TrimSuffix(renderYAMLEntries(missing, s.contentIndent(steps), tag, value), "\n")
+		return s.replace(start, end, text), nil
+	}
+
+	return nil, fmt.Errorf("%s is not a mapping", path[:len(steps)])
+}
+
+// DeleteYAMLValue returns src with the mapping entry or sequence item found at
+// path removed.
+func DeleteYAMLValue(src []byte, path Path) ([]byte, error) {
+	s, err := newYAMLSource(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("can't delete the root node")
+	}
+
+	if s.root == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path)
+	}
+
+	steps, node, err := s.locate(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) != len(path) {
+		return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:len(steps)+1])
+	}
+
+	step := steps[len(steps)-1]
+	parent := step.parent
+	endLine := s.entryEndLine(steps)
+
+	var start, next int
+	var hasNext bool
+	var empty string
+	var head *yaml.Node
+
+	if parent.Kind == yaml.MappingNode {
+		key := parent.Content[step.index-1]
+		start = s.offset(key.Line, key.Column)
+		if hasNext = step.index+1 < len(parent.Content); hasNext {
+			next = s.offset(parent.Content[step.index+1].Line, parent.Content[step.index+1].Column)
+		}
+		empty, head = "{}", key
+	} else {
+		start = s.dashOffset(node)
+		if hasNext = step.index+1 < len(parent.Content); hasNext {
+			next = s.dashOffset(parent.Content[step.index+1])
+		}
+		empty, head = "[]", node
+	}
+
+	startLine := s.lineOf(start)
+	if strings.TrimSpace(string(s.src[s.lineOffset(startLine):start])) != "" {
+		// The entry shares its line with its parent, as in "- key: value".
+		if hasNext {
+			return s.replace(start, next, ""), nil
+		}
+		return s.replace(start, s.lineEnd(endLine), empty), nil
+	}
+
+	startLine -= s.headCommentLines(head, startLine)
+	out := s.replace(s.lineOffset(startLine), s.lineOffset(endLine+1), "")
+
+	remaining := len(parent.Content) - 1
+	if parent.Kind == yaml.MappingNode {
+		remaining--
+	}
+
+	if remaining == 0 && len(steps) > 1 {
+		// The collection is now empty, make it explicit rather than null.
+		grandParent := steps[len(steps)-2]
+		if grandParent.parent.Kind == yaml.MappingNode {
+			colon := s.keyColonOffset(grandParent.parent.Content[grandParent.index-1])
+			if colon >= 0 && colon < s.lineOffset(startLine) {
+				out = append(append(append([]byte{}, out[:colon+1]...), " "+empty...), out[colon+1:]...)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// CopyYAMLEntry returns dst with the entry found at path replaced by the
+// entry found at the same path in src, or extended with it if dst lacks it.
+// The parent mapping of the entry must exist in dst.
+func CopyYAMLEntry(dst, src []byte, path Path) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("can't copy the root node")
+	}
+
+	d, err := newYAMLSource(dst)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newYAMLSource(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.root == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path)
+	}
+	sSteps, _, err := s.locate(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(sSteps) != len(path) {
+		return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:len(sSteps)+1])
+	}
+
+	var at, indent int
+	switch {
+	case d.root == nil && len(path) == 1 && !path[0].IsIndex:
+		at = len(dst)
+	case d.root == nil:
+		return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:1])
+	default:
+		dSteps, dNode, err := d.locate(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dSteps) == len(path) {
+			dStart, dEnd := d.valueRegion(dSteps)
+			sStart, sEnd := s.valueRegion(sSteps)
+			text := reindent(string(src[sStart:sEnd]), d.entryIndent(dSteps)-s.entryIndent(sSteps), true)
+			return d.replace(dStart, dEnd, text), nil
+		}
+
+		if len(dSteps) != len(path)-1 || path[len(path)-1].IsIndex || dNode.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:len(dSteps)+1])
+		}
+		if at, indent, err = d.appendOffset(dSteps, dNode); err != nil {
+			return nil, fmt.Errorf("%s: %w", path[:len(dSteps)], err)
+		}
+	}
+
+	start, end, err := s.entryRegion(sSteps)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	text := reindent(string(src[start:end]), indent-s.entryIndent(sSteps), false)
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	if at > 0 && dst[at-1] != '\n' {
+		text = "\n" + text
+	}
+
+	return d.replace(at, at, text), nil
+}
+
+// ConflictYAMLEntries returns dst with the entries found at paths in dst and
+// src surrounded by git style conflict markers. The result is not valid YAML
+// anymore.
+func ConflictYAMLEntries(dst, src []byte, paths []Path, oursLabel, theirsLabel string) ([]byte, error) {
+	d, err := newYAMLSource(dst)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newYAMLSource(src)
+	if err != nil {
+		return nil, err
+	}
+
+	type hunk struct {
+		start, end int
+		text       string
+	}
+
+	var hunks []hunk
+	for _, path := range paths {
+		if len(path) == 0 || d.root == nil {
+			return nil, fmt.Errorf("can't mark the root node as conflicting")
+		}
+
+		h := hunk{}
+		var indent int
+
+		dSteps, dNode, err := d.locate(path)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(dSteps) == len(path):
+			if h.start, h.end, err = d.entryRegion(dSteps); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			indent = d.entryIndent(dSteps)
+		case len(dSteps) == len(path)-1 && dNode.Kind == yaml.MappingNode:
+			if h.start, indent, err = d.appendOffset(dSteps, dNode); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			h.end = h.start
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:len(dSteps)+1])
+		}
+
+		ours := string(dst[h.start:h.end])
+		theirs := ""
+		if s.root != nil {
+			sSteps, _, err := s.locate(path)
+			if err != nil {
+				return nil, err
+			}
+			if len(sSteps) == len(path) {
+				start, end, err := s.entryRegion(sSteps)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				theirs = reindent(string(src[start:end]), indent-s.entryIndent(sSteps), false)
+			}
+		}
+
+		for _, t := range []*string{&ours, &theirs} {
+			if *t != "" && !strings.HasSuffix(*t, "\n") {
+				*t += "\n"
+			}
+		}
+
+		h.text = "<<<<<<< " + oursLabel + "\n" + ours + "=======\n" + theirs + ">>>>>>> " + theirsLabel + "\n"
+		if h.start > 0 && dst[h.start-1] != '\n' {
+			h.text = "\n" + h.text
+		}
+		hunks = append(hunks, h)
+	}
+
+	sort.Slice(hunks, func(i, j int) bool { return hunks[i].start > hunks[j].start })
+
+	out := append([]byte{}, dst...)
+	for i, h := range hunks {
+		if i > 0 && h.end > hunks[i-1].start {
+			return nil, fmt.Errorf("overlapping conflicts")
+		}
+		out = append(out[:h.start], append([]byte(h.text), out[h.end:]...)...)
+	}
+
+	return out, nil
+}
+
+type yamlStep struct {
+	parent *yaml.Node // mapping or sequence node
+	index  int        // index of the value node in parent.Content
+}
+
+type yamlSource struct {
+	src        []byte
+	lineStarts []int // lineStarts[l-1] is the offset of line l
+	root       *yaml.Node
+	endLine    int // first line past the first document
+}
+
+func newYAMLSource(src []byte) (*yamlSource, error) {
+	s := &yamlSource{src: src, lineStarts: []int{0}}
+	for i, c := range src {
+		if c == '\n' && i+1 < len(src) {
+			s.lineStarts = append(s.lineStarts, i+1)
+		}
+	}
+
+	doc := yaml.Node{}
+	if err := yaml.NewDecoder(bytes.NewReader(src)).Decode(&doc); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("yaml decoding failed: %w", err)
+	}
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		s.root = doc.Content[0]
+	}
+	if s.root != nil && s.root.Kind == yaml.ScalarNode && s.root.Tag == "!!null" {
+		s.root = nil
+	}
+
+	s.endLine = len(s.lineStarts) + 1
+	if s.root != nil {
+		for l := s.root.Line + 1; l <= len(s.lineStarts); l++ {
+			line := s.line(l)
+			if bytes.HasPrefix(line, []byte("---")) || bytes.HasPrefix(line, []byte("...")) {
+				if len(line) == 3 || line[3] == ' ' || line[3] == '\t' || line[3] == '\r' {
+					s.endLine = l
+					break
+				}
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// locate follows path and returns the steps leading to the deepest existing
+// node along with that node.
+func (s *yamlSource) locate(path Path) ([]yamlStep, *yaml.Node, error) {
+	var steps []yamlStep
+	node := s.root
+
+	for i, e := range path {
+		if node.Kind == yaml.AliasNode {
+			return nil, nil, fmt.Errorf("%s: aliases can't be edited", path[:i])
+		}
+		if (node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode) && node.Style&yaml.FlowStyle != 0 {
+			return nil, nil, fmt.Errorf("%s: flow style collections can't be edited", path[:i])
+		}
+
+		index := -1
+		switch {
+		case !e.IsIndex && node.Kind == yaml.MappingNode:
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == e.Key {
+					index = j + 1
+				}
+			}
+		case e.IsIndex && node.Kind == yaml.SequenceNode:
+			if e.Index < len(node.Content) {
+				index = e.Index
+			}
+		}
+
+		if index < 0 {
+			break
+		}
+
+		steps = append(steps, yamlStep{parent: node, index: index})
+		node = node.Content[index]
+	}
+
+	return steps, node, nil
+}
+
+// valueSpan returns the offsets of the text of the value node found at the
+// end of steps, and the line comment found on its first line.
+func (s *yamlSource) valueSpan(steps []yamlStep, node *yaml.Node) (int, int, string) {
+	step := steps[len(steps)-1]
+	start := s.offset(node.Line, node.Column)
+	end := s.lineEnd(s.entryEndLine(steps))
+
+	comment := node.LineComment
+	if step.parent.Kind == yaml.MappingNode {
+		if key := step.parent.Content[step.index-1]; comment == "" && key.Line == node.Line {
+			comment = key.LineComment
+		}
+	}
+	if strings.Contains(comment, "\n") {
+		comment = ""
+	}
+
+	return start, end, comment
+}
+
+// entryIndent returns the indentation of the key or dash of the entry found
+// at the end of steps.
+func (s *yamlSource) entryIndent(steps []yamlStep) int {
+	step := steps[len(steps)-1]
+	if step.parent.Kind == yaml.MappingNode {
+		return step.parent.Content[step.index-1].Column - 1
+	}
+	return s.column(s.dashOffset(step.parent.Content[step.index]))
+}
+
+// valueRegion returns the offsets of everything following the colon or dash
+// of the entry found at the end of steps.
+func (s *yamlSource) valueRegion(steps []yamlStep) (int, int) {
+	step := steps[len(steps)-1]
+	node := step.parent.Content[step.index]
+	end := s.lineEnd(s.entryEndLine(steps))
+
+	if step.parent.Kind == yaml.MappingNode {
+		if colon := s.keyColonOffset(step.parent.Content[step.index-1]); colon >= 0 {
+			return colon + 1, end
+		}
+		return s.offset(node.Line, node.Column), end
+	}
+
+	return s.dashOffset(node) + 1, end
+}
+
+// entryRegion returns the offsets of the lines of the entry found at the end
+// of steps, head comment included.
+func (s *yamlSource) entryRegion(steps []yamlStep) (int, int, error) {
+	step := steps[len(steps)-1]
+	node := step.parent.Content[step.index]
+
+	start, head := s.dashOffset(node), node
+	if step.parent.Kind == yaml.MappingNode {
+		head = step.parent.Content[step.index-1]
+		start = s.offset(head.Line, head.Column)
+	}
+
+	line := s.lineOf(start)
+	if strings.TrimSpace(string(s.src[s.lineOffset(line):start])) != "" {
+		return 0, 0, fmt.Errorf("entries sharing their line with their parent can't be edited")
+	}
+	line -= s.headCommentLines(head, line)
+
+	return s.lineOffset(line), s.lineOffset(s.entryEndLine(steps) + 1), nil
+}
+
+// appendOffset returns the offset at which entries can be appended to the
+// block mapping found at the end of steps, and their indentation.
+func (s *yamlSource) appendOffset(steps []yamlStep, mapping *yaml.Node) (int, int, error) {
+	if mapping.Style&yaml.FlowStyle != 0 || len(mapping.Content) == 0 {
+		return 0, 0, fmt.Errorf("flow style collections can't be edited")
+	}
+
+	last := make([]yamlStep, len(steps), len(steps)+1)
+	copy(last, steps)
+	last = append(last, yamlStep{parent: mapping, index: len(mapping.Content) - 1})
+
+	return s.lineOffset(s.entryEndLine(last) + 1), mapping.Content[0].Column - 1, nil
+}
+
+// contentIndent returns the indentation of the content of a block nested in
+// the entry found at the end of steps.
+func (s *yamlSource) contentIndent(steps []yamlStep) int {
+	step := steps[len(steps)-1]
+	if step.parent.Kind == yaml.MappingNode {
+		return step.parent.Content[step.index-1].Column - 1 + 2
+	}
+	dash := s.dashOffset(step.parent.Content[step.index])
+	return s.column(dash) + 2
+}
+
+// entryEndLine returns the last line of the mapping entry or sequence item
+// found at the end of steps, leaving out trailing blank lines and comments
+// which belong to whatever comes next.
+func (s *yamlSource) entryEndLine(steps []yamlStep) int {
+	step := steps[len(steps)-1]
+	node := step.parent.Content[step.index]
+
+	var startLine, entryIndent int
+	if step.parent.Kind == yaml.MappingNode {
+		key := step.parent.Content[step.index-1]
+		startLine, entryIndent = key.Line, key.Column-1
+	} else {
+		dash := s.dashOffset(node)
+		startLine, entryIndent = s.lineOf(dash), s.column(dash)
+	}
+
+	bound := s.endLine
+	for i := len(steps) - 1; i >= 0; i-- {
+		p, idx := steps[i].parent, steps[i].index
+		if p.Kind == yaml.MappingNode && idx+1 < len(p.Content) {
+			bound = p.Content[idx+1].Line
+			break
+		}
+		if p.Kind == yaml.SequenceNode && idx+1 < len(p.Content) {
+			bound = s.lineOf(s.dashOffset(p.Content[idx+1]))
+			break
+		}
+	}
+
+	blockIndent := -1
+	if node.Kind == yaml.ScalarNode && node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		for l := node.Line + 1; l < bound; l++ {
+			if !s.blank(l) {
+				blockIndent = s.indent(l)
+				break
+			}
+		}
+	}
+
+	last := bound - 1
+	for last > startLine && last >= node.Line {
+		if s.blank(last) {
+			last--
+			continue
+		}
+		if s.comment(last) {
+			switch {
+			case blockIndent >= 0 && s.indent(last) < blockIndent,
+				node.Kind == yaml.ScalarNode && blockIndent < 0,
+				node.Kind == yaml.AliasNode,
+				s.indent(last) <= entryIndent:
+				last--
+				continue
+			}
+		}
+		break
+	}
+
+	if last < node.Line {
+		last = node.Line
+	}
+
+	return last
+}
+
+// headCommentLines returns the number of comment lines directly above line
+// which belong to node.
+func (s *yamlSource) headCommentLines(node *yaml.Node, line int) int {
+	if node.HeadComment == "" {
+		return 0
+	}
+	n, lines := 0, strings.Count(node.HeadComment, "\n")+1
+	for n < lines && line-n-1 >= 1 && s.comment(line-n-1) {
+		n++
+	}
+	return n
+}
+
+// dashOffset returns the offset of the dash introducing the sequence item
+// node.
+func (s *yamlSource) dashOffset(node *yaml.Node) int {
+	i := s.offset(node.Line, node.Column) - 1
+	for ; i >= 0; i-- {
+		switch s.src[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		break
+	}
+	if i < 0 || s.src[i] != '-' {
+		return s.offset(node.Line, node.Column)
+	}
+	return i
+}
+
+// keyColonOffset returns the offset of the colon following the mapping key
+// node, or -1.
+func (s *yamlSource) keyColonOffset(key *yaml.Node) int {
+	i := s.offset(key.Line, key.Column)
+	switch key.Style {
+	case yaml.DoubleQuotedStyle:
+		for i++; i < len(s.src) && s.src[i] != '"'; i++ {
+			if s.src[i] == '\\' {
+				i++
+			}
+		}
+	case yaml.SingleQuotedStyle:
+		for i++; i < len(s.src); i++ {
+			if s.src[i] == '\'' {
+				if i+1 < len(s.src) && s.src[i+1] == '\'' {
+					i++
+					continue
+				}
+				break
+			}
+		}
+	}
+	for ; i < len(s.src) && s.src[i] != '\n'; i++ {
+		if s.src[i] == ':' && (i+1 == len(s.src) || strings.IndexByte(" \t\r\n", s.src[i+1]) >= 0) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *yamlSource) replace(start, end int, text string) []byte {
+	out := make([]byte, 0, len(s.src)-(end-start)+len(text))
+	out = append(out, s.src[:start]...)
+	out = append(out, text...)
+	return append(out, s.src[end:]...)
+}
+
+func (s *yamlSource) line(l int) []byte {
+	return bytes.TrimSuffix(s.src[s.lineOffset(l):s.lineEnd(l)], []byte("\r"))
+}
+
+func (s *yamlSource) lineOffset(l int) int {
+	if l > len(s.lineStarts) {
+		return len(s.src)
+	}
+	return s.lineStarts[l-1]
+}
+
+// lineEnd returns the offset of the newline ending line l.
+func (s *yamlSource) lineEnd(l int) int {
+	if i := bytes.IndexByte(s.src[s.lineOffset(l):], '\n'); i >= 0 {
+		return s.lineOffset(l) + i
+	}
+	return len(s.src)
+}
+
+func (s *yamlSource) lineOf(offset int) int {
+	l := 1
+	for l < len(s.lineStarts) && s.lineStarts[l] <= offset {
+		l++
+	}
+	return l
+}
+
+// offset converts a 1-based line and column, counted in characters, to a
+// byte offset.
+func (s *yamlSource) offset(line, column int) int {
+	o := s.lineOffset(line)
+	for c := 1; c < column && o < len(s.src); c++ {
+		_, n := utf8.DecodeRune(s.src[o:])
+		o += n
+	}
+	return o
+}
+
+func (s *yamlSource) column(offset int) int {
+	return utf8.RuneCount(s.src[s.lineOffset(s.lineOf(offset)):offset])
+}
+
+func (s *yamlSource) indent(l int) int {
+	line := s.line(l)
+	return len(line) - len(bytes.TrimLeft(line, " "))
+}
+
+func (s *yamlSource) blank(l int) bool {
+	return len(bytes.TrimSpace(s.line(l))) == 0
+}
+
+func (s *yamlSource) comment(l int) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(s.line(l)), []byte("#"))
+}
+
+// reindent shifts the lines of text by delta columns, leaving the first one
+// alone if skipFirst is set.
+func reindent(text string, delta int, skipFirst bool) string {
+	if delta == 0 {
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if (i == 0 && skipFirst) || strings.TrimSpace(line) == "" {
+			continue
+		}
+		if delta > 0 {
+			lines[i] = strings.Repeat(" ", delta) + line
+		} else {
+			n := len(line) - len(strings.TrimLeft(line, " "))
+			if n > -delta {
+				n = -delta
+			}
+			lines[i] = line[n:]
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// renderYAMLEntries renders path as nested block mappings ending with a
+// scalar.
+func renderYAMLEntries(path Path, indent int, tag, value string) string {
+	sb := strings.Builder{}
+	for i, e := range path {
+		sb.WriteString(strings.Repeat(" ", indent+2*i) + renderYAMLScalar("", "", e.Key, 0, "") + ":")
+		if i == len(path)-1 {
+			sb.WriteString(" " + renderYAMLScalar("", tag, value, indent+2*i+2, ""))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// renderYAMLScalar renders a scalar value meant to be written after a mapping
+// key or a sequence dash. Multi-line values are written as literal blocks
+// indented by indent spaces.
+func renderYAMLScalar(anchor, tag, value string, indent int, comment string) string {
+	head := ""
+	if anchor != "" {
+		head += "&" + anchor + " "
+	}
+	if tag != "" {
+		head += tag + " "
+	}
+	if comment != "" {
+		comment = " " + comment
+	}
+
+	if strings.Contains(value, "\n") && !strings.HasPrefix(value, " ") {
+		body := strings.TrimSuffix(value, "\n")
+		indicator := "|-"
+		if strings.HasSuffix(body, "\n") {
+			indicator = "|+"
+		} else if body != value {
+			indicator = "|"
+		}
+
+		sb := strings.Builder{}
+		sb.WriteString(head + indicator + comment)
+		for _, line := range strings.Split(body, "\n") {
+			sb.WriteString("\n")
+			if line != "" {
+				sb.WriteString(strings.Repeat(" ", indent) + line)
+			}
+		}
+		return sb.String()
+	}
+
+	node := yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	if strings.Contains(value, "\n") {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	b, err := yaml.Marshal(&node)
+	if err != nil {
+		b = []byte(fmt.Sprintf("%q", value))
+	}
+
+	return head + strings.TrimSuffix(string(b), "\n") + comment
+}
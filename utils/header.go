@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// Header describes an age file as far as it can be known without an
+// identity.
+type Header struct {
+	Armored     bool     `json:"armored"`
+	Size        int      `json:"size"`
+	PayloadSize int      `json:"payload_size"`
+	Stanzas     []Stanza `json:"stanzas"`
+}
+
+// Stanza describes a recipient stanza of an age header.
+type Stanza struct {
+	Type       string   `json:"type"`
+	Args       []string `json:"args,omitempty"`
+	KeyTag     string   `json:"key_tag,omitempty"`
+	WorkFactor int      `json:"work_factor,omitempty"`
+}
+
+func (s Stanza) String() string {
+	switch {
+	case s.KeyTag != "":
+		return s.Type + ":" + s.KeyTag
+	case s.WorkFactor != 0:
+		return fmt.Sprintf("%s:N=2^%d", s.Type, s.WorkFactor)
+	}
+	return s.Type
+}
+
+const headerSizeLimit = 1 << 20 // 1 MiB
+
+// ParseHeader reads an age file, binary or armored, and returns its header.
+// The payload is read to measure its size but is not decrypted.
+func ParseHeader(in io.Reader) (*Header, error) {
+	h := &Header{}
+
+	rr := bufio.NewReader(in)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		h.Armored = true
+		in = armor.NewReader(rr)
+	} else {
+		in = rr
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age file: %w", err)
+	}
+	h.Size = len(data)
+
+	// The header ends with the "--- " MAC line.
+	head := data
+	if len(head) > headerSizeLimit {
+		head = head[:headerSizeLimit]
+	}
+	mac := bytes.Index(head, []byte("\n--- "))
+	if mac < 0 {
+		return nil, fmt.Errorf("malformed age header: missing MAC line")
+	}
+	end := bytes.IndexByte(head[mac+1:], '\n')
+	if end < 0 {
+		return nil, fmt.Errorf("malformed age header: unterminated MAC line")
+	}
+	h.PayloadSize = len(data) - (mac + 1 + end + 1)
+
+	// Let age parse the header and hand us the stanzas.
+	rec := &stanzaRecorder{}
+	_, err = age.Decrypt(bytes.NewReader(data), rec)
+	if rec.stanzas == nil {
+		if err == nil {
+			err = errors.New("no stanza")
+		}
+		return nil, fmt.Errorf("malformed age header: %w", err)
+	}
+
+	for _, s := range rec.stanzas {
+		h.Stanzas = append(h.Stanzas, newStanza(s))
+	}
+
+	return h, nil
+}
+
+func newStanza(s *age.Stanza) Stanza {
+	st := Stanza{Type: s.Type, Args: s.Args}
+
+	switch s.Type {
+	case "ssh-ed25519", "ssh-rsa":
+		if len(s.Args) > 0 {
+			st.KeyTag = s.Args[0]
+		}
+	case "scrypt":
+		if len(s.Args) > 1 {
+			st.WorkFactor, _ = strconv.Atoi(s.Args[1])
+		}
+	}
+
+	return st
+}
+
+// stanzaRecorder is an age.Identity which records the stanzas it is offered
+// and never matches.
+type stanzaRecorder struct {
+	stanzas []*age.Stanza
+}
+
+var _ age.Identity = (*stanzaRecorder)(nil)
+
+func (r *stanzaRecorder) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	r.stanzas = stanzas
+	return nil, age.ErrIncorrectIdentity
+}
+
+// SSHKeyTag returns the tag identifying pk in ssh-ed25519 and ssh-rsa
+// stanzas.
+func SSHKeyTag(pk ssh.PublicKey) string {
+	h := sha256.Sum256(pk.Marshal())
+	return base64.RawStdEncoding.EncodeToString(h[:4])
+}
+
+// IsAgeArmored reports whether s looks like an armored age file.
+func IsAgeArmored(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), armor.Header)
+}
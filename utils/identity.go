@@ -10,14 +10,20 @@ import (
 	"filippo.io/age/agessh"
 )
 
+// OpenSSHIdentityFiles returns the default SSH keys loaded by
+// AddOpenSSHIdentities.
+func OpenSSHIdentityFiles() []string {
+	return []string{
+		os.ExpandEnv("$HOME/.ssh/id_rsa"),
+		os.ExpandEnv("$HOME/.ssh/id_ed25519"),
+	}
+}
+
 func AddOpenSSHIdentities(identities *[]age.Identity) {
 	// If they exist and are well-formed, load the default SSH keys. If they are
 	// passphrase protected, the passphrase will only be requested if the
 	// identity matches a recipient stanza.
-	for _, path := range []string{
-		os.ExpandEnv("$HOME/.ssh/id_rsa"),
-		os.ExpandEnv("$HOME/.ssh/id_ed25519"),
-	} {
+	for _, path := range OpenSSHIdentityFiles() {
 		content, err := os.ReadFile(path)
 		if err != nil {
 			continue
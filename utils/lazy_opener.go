@@ -8,18 +8,24 @@ import (
 type lazyOpener struct {
 	name      string
 	overwrite bool
+	perm      os.FileMode
 	f         *os.File
 	err       error
 }
 
 func NewLazyOpener(name string, overwrite bool) io.WriteCloser {
-	return &lazyOpener{name: name, overwrite: overwrite}
+	return &lazyOpener{name: name, overwrite: overwrite, perm: 0o660}
+}
+
+// NewLazyOpenerPerm is like NewLazyOpener but creates the file with perm.
+func NewLazyOpenerPerm(name string, overwrite bool, perm os.FileMode) io.WriteCloser {
+	return &lazyOpener{name: name, overwrite: overwrite, perm: perm}
 }
 
 func (l *lazyOpener) Write(p []byte) (n int, err error) {
 	if l.f == nil && l.err == nil {
 		oFlags := os.O_WRONLY | os.O_CREATE
-		perms := os.FileMode(0o660)
+		perms := l.perm
 
 		if l.overwrite {
 			stat, err := os.Stat(l.name)
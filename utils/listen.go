@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"io/fs"
+	"net"
+	"os"
+)
+
+// ListenUnix listens on the unix socket name, only accessible by its owner.
+// A socket left by a previous run is removed.
+func ListenUnix(name string) (net.Listener, error) {
+	if info, err := os.Lstat(name); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(name, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
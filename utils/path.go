@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+var (
+	ErrPathNotFound = errors.New("path not found")
+	ErrSkipChildren = errors.New("skip children")
+)
+
+// PathElem is a single step of a Path, either a mapping key or a sequence
+// index.
+type PathElem struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// Path is a location inside a YAML document, written `.db.password`,
+// `.hosts[0].name` or `."key.with.dots"`. The empty path `.` is the root node.
+type Path []PathElem
+
+func ParsePath(s string) (Path, error) {
+	var p Path
+
+	s = strings.TrimSpace(s)
+	if s == "" || s == "." {
+		return p, nil
+	}
+
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '.':
+			i++
+			if i == len(s) {
+				return nil, fmt.Errorf("invalid path %q: trailing dot", s)
+			}
+			if s[i] == '"' {
+				key, n, err := readQuotedKey(s[i:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %q: %w", s, err)
+				}
+				p = append(p, PathElem{Key: key})
+				i += n
+				continue
+			}
+			j := i
+			for j < len(s) && s[j] != '.' && s[j] != '[' {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid path %q: empty key at offset %d", s, i)
+			}
+			p = append(p, PathElem{Key: s[i:j]})
+			i = j
+		case '[':
+			j := strings.IndexByte(s[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated index", s)
+			}
+			idx, err := strconv.Atoi(s[i+1 : i+j])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid path %q: bad index %q", s, s[i+1:i+j])
+			}
+			p = append(p, PathElem{Index: idx, IsIndex: true})
+			i += j + 1
+		default:
+			if i == 0 {
+				// Be lenient with paths missing the leading dot.
+				s = "." + s
+				continue
+			}
+			return nil, fmt.Errorf("invalid path %q: unexpected %q at offset %d", s, s[i], i)
+		}
+	}
+
+	return p, nil
+}
+
+func readQuotedKey(s string) (string, int, error) {
+	for j := 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '"':
+			key, err := strconv.Unquote(s[:j+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("bad quoted key %s", s[:j+1])
+			}
+			return key, j + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted key")
+}
+
+func (p Path) String() string {
+	if len(p) == 0 {
+		return "."
+	}
+
+	sb := strings.Builder{}
+	for _, e := range p {
+		if e.IsIndex {
+			fmt.Fprintf(&sb, "[%d]", e.Index)
+		} else if e.Key == "" || strings.ContainsAny(e.Key, `.[]" `) {
+			sb.WriteString("." + strconv.Quote(e.Key))
+		} else {
+			sb.WriteString("." + e.Key)
+		}
+	}
+	return sb.String()
+}
+
+// Child returns a copy of p extended with elem.
+func (p Path) Child(elem PathElem) Path {
+	c := make(Path, len(p), len(p)+1)
+	copy(c, p)
+	return append(c, elem)
+}
+
+// HasPrefix reports whether prefix is p or one of its ancestors.
+func (p Path) HasPrefix(prefix Path) bool {
+	if len(prefix) > len(p) {
+		return false
+	}
+	for i := range prefix {
+		if p[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the node found at path starting from node, which can be a
+// document node. Aliases are followed.
+func Lookup(node *yaml.Node, path Path) (*yaml.Node, error) {
+	node = resolve(node)
+
+	for i, e := range path {
+		var next *yaml.Node
+
+		switch {
+		case e.IsIndex && node.Kind == yaml.SequenceNode:
+			if e.Index < len(node.Content) {
+				next = node.Content[e.Index]
+			}
+		case !e.IsIndex && node.Kind == yaml.MappingNode:
+			if _, v := MappingEntry(node, e.Key); v != nil {
+				next = v
+			}
+		}
+
+		if next == nil {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:i+1])
+		}
+
+		node = resolve(next)
+	}
+
+	return node, nil
+}
+
+// MappingEntry returns the key and value nodes of the entry named key in the
+// mapping node m.
+func MappingEntry(m *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i], m.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// Walk calls fn for node and every node below it, depth first, along with
+// its path. Aliases are not followed. Returning ErrSkipChildren from fn prevents
+// Walk from descending into the node.
+func Walk(node *yaml.Node, fn func(Path, *yaml.Node) error) error {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	return walk(nil, node, fn)
+}
+
+func walk(path Path, node *yaml.Node, fn func(Path, *yaml.Node) error) error {
+	if err := fn(path, node); err == ErrSkipChildren {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Tag == "!!merge" {
+				continue
+			}
+			if err := walk(path.Child(PathElem{Key: key.Value}), node.Content[i+1], fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range node.Content {
+			if err := walk(path.Child(PathElem{Index: i, IsIndex: true}), c, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func resolve(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
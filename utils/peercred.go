@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrPeerCredentialsUnsupported is returned by PeerUID on platforms where the
+// credentials of the peer of a unix socket can't be known.
+var ErrPeerCredentialsUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// peerControl calls fn with the file descriptor of conn.
+func peerControl(conn net.Conn, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T is not a unix socket", conn)
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	if err := raw.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+
+	return fnErr
+}
@@ -0,0 +1,23 @@
+//go:build darwin || freebsd
+
+package utils
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerUID returns the uid of the process at the other end of the unix socket
+// conn.
+func PeerUID(conn net.Conn) (int, error) {
+	var cred *unix.Xucred
+	err := peerControl(conn, func(fd int) (err error) {
+		cred, err = unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
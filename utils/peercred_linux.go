@@ -0,0 +1,23 @@
+//go:build linux
+
+package utils
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerUID returns the uid of the process at the other end of the unix socket
+// conn.
+func PeerUID(conn net.Conn) (int, error) {
+	var cred *unix.Ucred
+	err := peerControl(conn, func(fd int) (err error) {
+		cred, err = unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
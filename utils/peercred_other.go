@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package utils
+
+import (
+	"net"
+)
+
+// PeerUID returns ErrPeerCredentialsUnsupported as peer credentials are not
+// supported on this platform.
+func PeerUID(_ net.Conn) (int, error) {
+	return -1, ErrPeerCredentialsUnsupported
+}
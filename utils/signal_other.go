@@ -0,0 +1,22 @@
+//go:build !unix
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// StopSignals are the signals long running commands stop on.
+var StopSignals = []os.Signal{os.Interrupt}
+
+// ParseSignal returns the signal named name, only KILL can be sent to other
+// processes on this platform.
+func ParseSignal(name string) (os.Signal, error) {
+	if n := strings.TrimPrefix(strings.ToUpper(name), "SIG"); n == "KILL" {
+		return os.Kill, nil
+	}
+
+	return nil, fmt.Errorf("unsupported signal %q", name)
+}
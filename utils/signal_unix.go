@@ -0,0 +1,30 @@
+//go:build unix
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// StopSignals are the signals long running commands stop on.
+var StopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// ParseSignal returns the signal named name, with or without the SIG prefix.
+func ParseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return nil, fmt.Errorf("unknown signal %q", name)
+	}
+
+	return sig, nil
+}
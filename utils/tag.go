@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+)
+
+// AgeTag is the YAML tag marking values to encrypt.
+const AgeTag = "!crypto/age"
+
+// TagAttributes lists the attributes which can follow AgeTag, as in
+// `!crypto/age:DoubleQuoted,NoTag`.
+var TagAttributes = []string{"DoubleQuoted", "SingleQuoted", "Literal", "Folded", "Flow", "NoTag", BinaryAttribute}
+
+// BinaryAttribute marks values holding base64 encoded binary data, which
+// `yage k8s secret` decodes.
+const BinaryAttribute = "Binary"
+
+// ParseAgeTag reports whether tag is AgeTag, with or without attributes, and
+// returns its attributes.
+func ParseAgeTag(tag string) ([]string, bool) {
+	if tag == AgeTag {
+		return nil, true
+	}
+	if !strings.HasPrefix(tag, AgeTag+":") {
+		return nil, false
+	}
+	return strings.Split(strings.TrimPrefix(tag, AgeTag+":"), ","), true
+}
+
+// IsTagAttribute reports whether a is one of TagAttributes.
+func IsTagAttribute(a string) bool {
+	return slices.Contains(TagAttributes, a)
+}
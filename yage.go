@@ -14,7 +14,7 @@ import (
 )
 
 func main() {
-	if err := yagecmd.YAGECmd.Execute(); err != nil {
+	if err := yagecmd.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
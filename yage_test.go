@@ -9,21 +9,71 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	osexec "os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/armor"
+	"go.yaml.in/yaml/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	kmsapi "k8s.io/kms/apis/v2"
 
+	"sylr.dev/yage/v2/cmd/agent"
+	"sylr.dev/yage/v2/cmd/check"
+	"sylr.dev/yage/v2/cmd/credentials"
+	"sylr.dev/yage/v2/cmd/csi"
+	"sylr.dev/yage/v2/cmd/csi/v1alpha1"
 	"sylr.dev/yage/v2/cmd/decrypt"
+	"sylr.dev/yage/v2/cmd/diff"
 	"sylr.dev/yage/v2/cmd/encrypt"
+	"sylr.dev/yage/v2/cmd/exec"
+	"sylr.dev/yage/v2/cmd/get"
+	"sylr.dev/yage/v2/cmd/git"
+	"sylr.dev/yage/v2/cmd/helm"
+	"sylr.dev/yage/v2/cmd/history"
+	"sylr.dev/yage/v2/cmd/inspect"
+	"sylr.dev/yage/v2/cmd/k8s"
+	"sylr.dev/yage/v2/cmd/kms"
+	"sylr.dev/yage/v2/cmd/ls"
+	"sylr.dev/yage/v2/cmd/scan"
+	"sylr.dev/yage/v2/cmd/serve"
+	"sylr.dev/yage/v2/cmd/set"
+	"sylr.dev/yage/v2/cmd/template"
+	"sylr.dev/yage/v2/cmd/terraform"
 	"sylr.dev/yage/v2/utils"
 )
 
+// TestMain runs yage instead of the tests when YAGE_TEST_MAIN is set, so that
+// tests can run scripts invoking the test binary as yage.
+func TestMain(m *testing.M) {
+	if os.Getenv("YAGE_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestVectors(t *testing.T) {
 	var defaultIDs []age.Identity
 
@@ -364,7 +414,7 @@ dup: *password # alias comment`),
 			encryptOut := bytes.NewBuffer(nil)
 
 			// decrypt
-			err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, in, decryptOut, test.DiscardNoTag, false, false)
+			err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, in, decryptOut, test.DiscardNoTag, false, false, "")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -385,3 +435,1881 @@ dup: *password # alias comment`),
 		}
 	}
 }
+
+func TestGet(t *testing.T) {
+	input := `db:
+  user: app
+  password: !crypto/age:DoubleQuoted |
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+    OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+    amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+    alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+    gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+    -----END AGE ENCRYPTED FILE-----
+`
+
+	tests := []struct {
+		Path     string
+		JSON     bool
+		Expected string
+	}{
+		{Path: ".db.password", Expected: "ThisIsMyReallyEncryptedPassword\n"},
+		{Path: ".db.user", Expected: "app\n"},
+		{Path: ".db", JSON: true, Expected: `{"password":"ThisIsMyReallyEncryptedPassword","user":"app"}` + "\n"},
+	}
+
+	for _, test := range tests {
+		path, err := utils.ParsePath(test.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := bytes.NewBuffer(nil)
+		err = get.Get([]string{"./testdata/yaml.key"}, bytes.NewBufferString(input), out, path, false, test.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out.String() != test.Expected {
+			t.Errorf("Test \"%s\" failed:\nExpected:\n%sActual:\n%s", test.Path, test.Expected, out.String())
+		}
+	}
+
+	path, _ := utils.ParsePath(".db.missing")
+	err := get.Get([]string{"./testdata/yaml.key"}, bytes.NewBufferString(input), io.Discard, path, false, false)
+	if !errors.Is(err, utils.ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound, got %v", err)
+	}
+}
+
+func TestSetUnset(t *testing.T) {
+	input := `# database settings
+db:
+  user: app # the user
+  password: !crypto/age:DoubleQuoted |-
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+    OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+    amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+    alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+    gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+    -----END AGE ENCRYPTED FILE-----
+
+hosts:   [a, b]
+`
+
+	recFile, err := os.Open("./testdata/yaml.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := age.ParseRecipients(recFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, _ := utils.ParsePath(".api.token")
+	out, err := set.Set(recs, []byte(input), path, "MyToken", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(out), input+"api:\n  token: !crypto/age |-\n") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	value := bytes.NewBuffer(nil)
+	if err := get.Get([]string{"./testdata/yaml.key"}, bytes.NewReader(out), value, path, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if value.String() != "MyToken\n" {
+		t.Errorf("expected %q, got %q", "MyToken\n", value.String())
+	}
+
+	out, err = utils.DeleteYAMLValue(out, path[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != input {
+		t.Errorf("unexpected output after unset:\n%s", out)
+	}
+
+	path, _ = utils.ParsePath(".db.user")
+	out, err = set.Set(recs, []byte(input), path, "admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), "# database settings\ndb:\n  user: !crypto/age |- # the user\n    -----BEGIN AGE ENCRYPTED FILE-----\n") ||
+		!strings.HasSuffix(string(out), "    -----END AGE ENCRYPTED FILE-----\n"+input[strings.Index(input, "  password:"):]) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "secrets.yaml")
+	link := filepath.Join(dir, "link.yaml")
+
+	if err := os.WriteFile(target, []byte("old\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("secrets.yaml", link); err != nil {
+		t.Skip(err)
+	}
+
+	// Writing through a symbolic link replaces its target, keeping its mode.
+	if err := utils.WriteFileAtomic(link, []byte("new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected %s to still be a symbolic link", link)
+	}
+	if content, err := os.ReadFile(target); err != nil || string(content) != "new\n" {
+		t.Errorf("Unexpected content of %s: %q, %v", target, content, err)
+	}
+	if info, err := os.Stat(target); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o640 {
+		t.Errorf("Expected mode 0640 for %s, got %v", target, info.Mode())
+	}
+
+	created := filepath.Join(dir, "created.yaml")
+	if err := utils.WriteFileAtomic(created, []byte("new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(created); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600 for %s, got %v", created, info.Mode())
+	}
+}
+
+func TestLs(t *testing.T) {
+	input := `db:
+  password: !crypto/age:DoubleQuoted |-
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+    OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+    amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+    alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+    gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+    -----END AGE ENCRYPTED FILE-----
+  user: !crypto/age:NoTag app
+`
+
+	entries, err := ls.List("test.yaml", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.Path != ".db.password" || !e.Encrypted || e.Header == nil || e.Error != "" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	if len(e.Header.Stanzas) != 1 || e.Header.Stanzas[0].Type != "X25519" {
+		t.Errorf("unexpected stanzas: %+v", e.Header.Stanzas)
+	}
+	if e.Header.PayloadSize != 16+len("ThisIsMyReallyEncryptedPassword")+16 {
+		t.Errorf("unexpected payload size: %d", e.Header.PayloadSize)
+	}
+
+	if e := entries[1]; e.Path != ".db.user" || e.Encrypted || len(e.Attributes) != 1 || e.Attributes[0] != "NoTag" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub", "./testdata/good_ed25519_key.txt.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary := &bytes.Buffer{}
+	w, err := age.Encrypt(binary, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	armored := &bytes.Buffer{}
+	aw := armor.NewWriter(armored)
+	if _, err := aw.Write(binary.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("db:\n  password: !crypto/age s3cr3t\n"), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := inspect.KnownSSHKeys(nil, []string{"./testdata/good_ed25519_key.txt.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := utils.ParsePath(".db.password")
+
+	tests := []struct {
+		name     string
+		in       []byte
+		path     utils.Path
+		yamlPath bool
+		armored  bool
+	}{
+		{"binary", binary.Bytes(), nil, false, false},
+		{"armored", armored.Bytes(), nil, false, true},
+		{"yaml", encrypted.Bytes(), password, true, true},
+	}
+
+	for _, tc := range tests {
+		report, err := inspect.Inspect(bytes.NewReader(tc.in), tc.path, tc.yamlPath, known)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if report.Armored != tc.armored || report.PayloadSize == 0 {
+			t.Errorf("%s: unexpected header: %+v", tc.name, report.Header)
+		}
+
+		out := &bytes.Buffer{}
+		if err := inspect.WriteReport(out, report); err != nil {
+			t.Fatal(err)
+		}
+		expected := regexp.MustCompile(`(?m)^recipients: 2\n  - X25519 \(recipient can't be identified from the header\)\n  - ssh-ed25519 \S+ matches \./testdata/good_ed25519_key\.txt\.pub:1$`)
+		if !expected.MatchString(out.String()) {
+			t.Errorf("%s: unexpected report:\n%s", tc.name, out)
+		}
+	}
+
+	if _, err := inspect.Inspect(bytes.NewReader(encrypted.Bytes()), nil, false, known); err == nil {
+		t.Error("Expected an error inspecting YAML without a path")
+	}
+}
+
+func TestTextconv(t *testing.T) {
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := utils.ParseIdentitiesFile("testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("user: app\npassword: !crypto/age s3cr3t\n"), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	file := &bytes.Buffer{}
+	w, err := age.Encrypt(file, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "s3cr3t\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload holds a nonce and the authentication tag of its only chunk.
+	redacted := fmt.Sprintf("age encrypted file (armored: false, payload: %d bytes, sha256: %s)\nrecipients: X25519\n", 16+len("s3cr3t\n")+16, git.Fingerprint(file.Bytes()))
+
+	var values struct{ Password string }
+	if err := yaml.Unmarshal(encrypted.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	redactedYAML := "user: app\npassword: !crypto/age \"<redacted: X25519 sha256:" + git.Fingerprint([]byte(strings.TrimSpace(values.Password))) + ">\"\n"
+
+	tests := []struct {
+		name       string
+		identities []age.Identity
+		in         []byte
+		expected   string
+	}{
+		{"yaml", identities, encrypted.Bytes(), "user: app\npassword: !crypto/age s3cr3t\n"},
+		{"yaml redacted", nil, encrypted.Bytes(), redactedYAML},
+		{"yaml wrong identity", []age.Identity{other}, encrypted.Bytes(), redactedYAML},
+		{"age", identities, file.Bytes(), "s3cr3t\n"},
+		{"age redacted", nil, file.Bytes(), redacted},
+		{"age wrong identity", []age.Identity{other}, file.Bytes(), redacted},
+		{"other", nil, []byte("key: [unclosed\n"), "key: [unclosed\n"},
+	}
+
+	for _, tc := range tests {
+		out := &bytes.Buffer{}
+		if err := git.Textconv(tc.identities, bytes.NewReader(tc.in), out); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if out.String() != tc.expected {
+			t.Errorf("%s: expected:\n%q\nactual:\n%q", tc.name, tc.expected, out)
+		}
+	}
+
+	// Encrypting a value again to the same recipients changes its rendering.
+	again := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("user: app\npassword: !crypto/age s3cr3t\n"), again); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := git.Textconv(nil, again, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() == redactedYAML || !strings.HasPrefix(out.String(), "user: app\npassword: !crypto/age \"<redacted: X25519 sha256:") {
+		t.Errorf("Unexpected rendering of the value encrypted again: %q", out)
+	}
+}
+
+func TestGitInstall(t *testing.T) {
+	if _, err := osexec.LookPath("git"); err != nil {
+		t.Skip(err)
+	}
+
+	// Make the test binary the yage git runs.
+	bin := t.TempDir()
+	if err := os.Symlink(os.Args[0], filepath.Join(bin, "yage")); err != nil {
+		t.Skip(err)
+	}
+	key, err := filepath.Abs("testdata/yaml.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := filepath.Abs("testdata/yaml.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := t.TempDir()
+	env := append(os.Environ(),
+		"YAGE_TEST_MAIN=1",
+		"HOME="+repo,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+	)
+	run := func(name string, args ...string) string {
+		t.Helper()
+		cmd := osexec.Command(name, args...)
+		cmd.Dir, cmd.Env = repo, env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %v: %v: %s", name, args, err, out)
+		}
+		return string(out)
+	}
+
+	run("git", "init", "-q")
+	// Installing twice does not duplicate the attributes.
+	for range 2 {
+		run(filepath.Join(bin, "yage"), "git", "install", "--merge", "-i", key, "-R", pub, "*.yaml.age")
+	}
+
+	config := map[string]string{
+		"diff.yage.textconv":      "yage git textconv -i " + key,
+		"diff.yage.cachetextconv": "false",
+		"merge.yage.driver":       "yage git merge-driver -i " + key + " -R " + pub + " %O %A %B %P",
+	}
+	for k, v := range config {
+		if actual := strings.TrimSpace(run("git", "config", "--local", k)); actual != v {
+			t.Errorf("%s: expected %q, got %q", k, v, actual)
+		}
+	}
+
+	attributes, err := os.ReadFile(filepath.Join(repo, ".gitattributes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(attributes) != "*.yaml.age diff=yage merge=yage\n" {
+		t.Errorf("Unexpected .gitattributes:\n%s", attributes)
+	}
+
+	// git diff shows decrypted values.
+	recipients, err := encrypt.Recipients(nil, []string{pub}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"pw1", "pw2"} {
+		encrypted := &bytes.Buffer{}
+		if err := encrypt.EncryptYAML(recipients, strings.NewReader("password: !crypto/age "+password+"\n"), encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, "secrets.yaml.age"), encrypted.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if password == "pw1" {
+			run("git", "add", ".")
+			run("git", "commit", "-qm", "secrets")
+		}
+	}
+	diff := run("git", "diff")
+	if !strings.Contains(diff, "\n-password: !crypto/age pw1\n+password: !crypto/age pw2\n") {
+		t.Errorf("Unexpected diff:\n%s", diff)
+	}
+}
+
+func TestLog(t *testing.T) {
+	if _, err := osexec.LookPath("git"); err != nil {
+		t.Skip(err)
+	}
+
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := utils.ParseIdentitiesFile("testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := osexec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(),
+			"HOME="+repo,
+			"GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+
+	commits := []struct {
+		content    string
+		recipients []age.Recipient
+	}{
+		{"user: app\npassword: !crypto/age pw1\n", recipients},
+		{"user: app\npassword: !crypto/age pw2\n", recipients},
+		{"user: app\npassword: !crypto/age pw2\n", []age.Recipient{other.Recipient()}},
+		{"user: admin\npassword: !crypto/age pw2\n", recipients},
+		{"user: admin\n", recipients},
+	}
+	for i, c := range commits {
+		encrypted := &bytes.Buffer{}
+		if err := encrypt.EncryptYAML(c.recipients, strings.NewReader(c.content), encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, "secrets.yaml"), encrypted.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		git("add", ".")
+		git("commit", "-qm", strconv.Itoa(i))
+	}
+
+	path, _ := utils.ParsePath(".password")
+	revs, err := history.Log(identities, filepath.Join(repo, "secrets.yaml"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []string
+	for _, r := range revs {
+		value := "-"
+		if r.Value != nil {
+			value = *r.Value
+		}
+		actual = append(actual, r.Change+" "+value)
+	}
+	expected := []string{"removed -", "undecryptable -", `changed "pw2"`, `added "pw1"`}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\nActual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	if revs[1].Error == "" {
+		t.Error("Undecryptable revision without error")
+	}
+}
+
+func TestScan(t *testing.T) {
+	if _, err := osexec.LookPath("git"); err != nil {
+		t.Skip(err)
+	}
+
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := filepath.Abs("testdata/yaml.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := t.TempDir()
+	env := append(os.Environ(),
+		"YAGE_TEST_MAIN=1",
+		"HOME="+repo,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	run := func(name string, args ...string) (string, error) {
+		cmd := osexec.Command(name, args...)
+		cmd.Dir, cmd.Env = repo, env
+		out, err := cmd.Output()
+		return string(out), err
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func() string {
+		t.Helper()
+		for _, args := range [][]string{{"add", "-A"}, {"commit", "-qm", "commit"}} {
+			if out, err := run("git", args...); err != nil {
+				t.Fatalf("git %v: %v: %s", args, err, out)
+			}
+		}
+		out, _ := run("git", "rev-parse", "HEAD")
+		return strings.TrimSpace(out)
+	}
+
+	if out, err := run("git", "init", "-q"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("user: app\npassword: !crypto/age hunter2-s3cr3t\ntoken: !crypto/age abc\n"), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	write("secrets.yaml", encrypted.String())
+	// Leaked base64 encoded in a commit and removed in the next one.
+	write("config.txt", "a: 1\nb: "+base64.StdEncoding.EncodeToString([]byte("hunter2-s3cr3t"))+"\n")
+	added := commit()
+	write("config.txt", "a: 1\n")
+	removed := commit()
+	// Leaked in plain in an untracked file.
+	write("app.env", "USER=app\nPASSWORD=hunter2-s3cr3t\n")
+
+	out, err := run(os.Args[0], "scan", "--json", "-i", key, "secrets.yaml")
+	var exitErr *osexec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("Expected exit code 1, got %v: %s", err, out)
+	}
+
+	hits := []scan.Hit{}
+	if err := json.Unmarshal([]byte(out), &hits); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	var actual []string
+	for _, h := range hits {
+		actual = append(actual, fmt.Sprintf("%s %s:%d %s%s %s", h.Source, h.File, h.Line, h.SecretFile, h.SecretPath, h.Encoding))
+	}
+	sort.Strings(actual)
+	expected := []string{
+		added + " config.txt:2 secrets.yaml.password base64",
+		removed + " config.txt:2 secrets.yaml.password base64",
+		"worktree app.env:2 secrets.yaml.password plain",
+	}
+	sort.Strings(expected)
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\nActual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+
+	if out, err := run(os.Args[0], "scan", "--no-worktree", "-i", key, "secrets.yaml"); err == nil || strings.Contains(out, "worktree") {
+		t.Errorf("Unexpected output without worktree: %v: %s", err, out)
+	}
+
+	// Values reached through aliases and merge keys are only reported at the
+	// path where they are defined.
+	encrypted.Reset()
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("base: &base\n  pw: !crypto/age s3cr3t-base\nprod:\n  <<: *base\nstaging: *base\ntoken: &token !crypto/age s3cr3t-token\ntokens: [*token]\n"), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	write("aliases.yaml", encrypted.String())
+	ids, err := utils.ParseIdentitiesFile("./testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := scan.Secrets(ids, filepath.Join(repo, "aliases.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual = nil
+	for _, s := range secrets {
+		actual = append(actual, s.Path+" "+s.Value)
+	}
+	if expected := ".base.pw s3cr3t-base\n.token s3cr3t-token"; strings.Join(actual, "\n") != expected {
+		t.Errorf("Expected:\n%s\nActual:\n%s", expected, strings.Join(actual, "\n"))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldInput := `db:
+  user: app
+  password: !crypto/age |-
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+    OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+    amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+    alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+    gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+    -----END AGE ENCRYPTED FILE-----
+`
+	newInput := `db:
+  user: admin
+  password: !crypto/age NewPassword
+  port: 5432
+`
+
+	ids, err := utils.ParseIdentitiesFile("./testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldDocs, err := decrypt.DecryptDocuments(ids, strings.NewReader(oldInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDocs, err := decrypt.DecryptDocuments(ids, strings.NewReader(newInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Redacted bool
+		Expected string
+	}{
+		{
+			Redacted: false,
+			Expected: `~ .db.user: "app" -> "admin"
+~ .db.password: "ThisIsMyReallyEncryptedPassword" -> "NewPassword"
++ .db.port: 5432
+`,
+		},
+		{
+			Redacted: true,
+			Expected: `~ .db.user: "app" -> "admin"
+~ .db.password: changed (secret)
++ .db.port: 5432
+`,
+		},
+	}
+
+	for _, test := range tests {
+		out := bytes.NewBuffer(nil)
+		if err := diff.WriteChanges(out, diff.Diff(oldDocs, newDocs), test.Redacted); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.Expected {
+			t.Errorf("Expected:\n%sActual:\n%s", test.Expected, out.String())
+		}
+	}
+}
+
+func TestDiffRedacted(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Old      string
+		New      string
+		Expected string
+	}{
+		{
+			Name:     "mapping becomes scalar",
+			Old:      "db:\n  password: !crypto/age s3cr3t\n",
+			New:      "db: none\n",
+			Expected: "~ .db: changed (secret)\n",
+		},
+		{
+			Name:     "scalar becomes sequence",
+			Old:      "db: none\n",
+			New:      "db:\n- !crypto/age s3cr3t\n",
+			Expected: "~ .db: changed (secret)\n",
+		},
+		{
+			Name:     "alias",
+			Old:      "password: &pw !crypto/age s3cr3t\n",
+			New:      "password: &pw !crypto/age s3cr3t\ndup: *pw\n",
+			Expected: "+ .dup: added (secret)\n",
+		},
+		{
+			Name:     "merge key",
+			Old:      "base: &base\n  password: !crypto/age s3cr3t\n",
+			New:      "base: &base\n  password: !crypto/age s3cr3t\napp:\n  <<: *base\n",
+			Expected: "+ .app.<<.password: added (secret)\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			oldDocs, err := decrypt.DecryptDocuments(nil, strings.NewReader(test.Old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			newDocs, err := decrypt.DecryptDocuments(nil, strings.NewReader(test.New))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := bytes.NewBuffer(nil)
+			if err := diff.WriteChanges(out, diff.Diff(oldDocs, newDocs), true); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.Expected {
+				t.Errorf("Expected:\n%sActual:\n%s", test.Expected, out.String())
+			}
+			if strings.Contains(out.String(), "s3cr3t") {
+				t.Errorf("Secret leaked:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := `db:
+  user: app
+  password: !crypto/age pw1
+api:
+  token: !crypto/age tok1
+  url: http://x
+`
+	ours := `db:
+  user: admin
+  password: !crypto/age pw1
+api:
+  token: !crypto/age tok2
+`
+	theirs := `db:
+  user: app
+  password: !crypto/age pw3
+api:
+  token: !crypto/age tok3
+  url: http://x
+  retries: 3
+`
+	expected := `db:
+  user: admin
+  password: !crypto/age pw3
+api:
+<<<<<<< ours
+  token: !crypto/age tok2
+=======
+  token: !crypto/age tok3
+>>>>>>> theirs
+  retries: 3
+`
+
+	out, conflicts, err := git.Merge(nil, nil, []byte(base), []byte(ours), []byte(theirs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].String() != ".api.token" {
+		t.Errorf("Unexpected conflicts: %v", conflicts)
+	}
+	if string(out) != expected {
+		t.Errorf("Expected:\n%sActual:\n%s", expected, out)
+	}
+}
+
+func TestMergeRecipients(t *testing.T) {
+	var ids [3]*age.X25519Identity
+	for i := range ids {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	encryptTo := func(in string, ids ...*age.X25519Identity) []byte {
+		var recipients []age.Recipient
+		for _, id := range ids {
+			recipients = append(recipients, id.Recipient())
+		}
+		out := &bytes.Buffer{}
+		if err := encrypt.EncryptYAML(recipients, strings.NewReader(in), out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+
+	base := encryptTo("user: app\npassword: !crypto/age pw1\n", ids[0])
+	ours := encryptTo("user: admin\npassword: !crypto/age pw1\n", ids[0])
+	theirs := encryptTo("user: app\npassword: !crypto/age pw2\n", ids[0], ids[1])
+
+	identities := []age.Identity{ids[0], ids[1]}
+	out, _, err := git.Merge(identities, nil, base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The value taken from theirs is copied with its recipients.
+	password := func(out []byte, id age.Identity) (string, error) {
+		docs, err := decrypt.DecryptDocuments([]age.Identity{id}, bytes.NewReader(out))
+		if err != nil {
+			return "", err
+		}
+		node, err := utils.Lookup(docs[0].Node, utils.Path{{Key: "password"}})
+		if err != nil {
+			return "", err
+		}
+		return node.Value, nil
+	}
+	for _, id := range ids[:2] {
+		if pw, err := password(out, id); err != nil || pw != "pw2" {
+			t.Errorf("Unexpected password: %q %v", pw, err)
+		}
+	}
+	if !bytes.Contains(out, theirs[bytes.Index(theirs, []byte("-----BEGIN")):]) {
+		t.Errorf("Ciphertext of theirs not copied:\n%s", out)
+	}
+
+	// Recipients of ours the merging user holds no identity of do not
+	// prevent the merge.
+	ours = encryptTo("user: admin\npassword: !crypto/age pw1\n", ids[0], ids[2])
+	if _, _, err := git.Merge(identities, nil, base, ours, theirs); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Given recipients replace those of theirs.
+	out, _, err = git.Merge(identities, []age.Recipient{ids[0].Recipient(), ids[2].Recipient()}, base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := password(out, ids[1]); err == nil {
+		t.Error("Value taken from theirs is still encrypted to the recipients of theirs")
+	}
+	if pw, err := password(out, ids[2]); err != nil || pw != "pw2" {
+		t.Errorf("Unexpected password: %q %v", pw, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	input := `db:
+  user: app
+  password: !crypto/age hunter2
+  api_key: abc
+  token:
+  dbPassword: hunter2
+  client_secret: abc
+  apiKey: abc
+  secretName: db
+  existingSecret: db
+  secretKeyRef: db
+  passthrough: true
+  bypass: true
+  tokenizer: simple
+  other: !crypto/age:Bold |-
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+    OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+    amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+    alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+    gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+    -----END AGE ENCRYPTED FILE-----
+`
+	expected := []string{
+		"test.yaml:3:13: plaintext: .db.password: tagged value is not encrypted",
+		"test.yaml:4:12: untagged-secret: .db.api_key: value matches a secret key pattern but is not tagged",
+		"test.yaml:6:15: untagged-secret: .db.dbPassword: value matches a secret key pattern but is not tagged",
+		"test.yaml:7:18: untagged-secret: .db.client_secret: value matches a secret key pattern but is not tagged",
+		"test.yaml:8:11: untagged-secret: .db.apiKey: value matches a secret key pattern but is not tagged",
+		`test.yaml:15:10: unknown-attribute: .db.other: unknown tag attribute "Bold"`,
+	}
+
+	keys := []*regexp.Regexp{regexp.MustCompile(check.DefaultSecretKeys[0])}
+	var notKeys []*regexp.Regexp
+	for _, s := range check.DefaultNotSecretKeys {
+		notKeys = append(notKeys, regexp.MustCompile(s))
+	}
+
+	var actual []string
+	for _, f := range check.Check("test.yaml", strings.NewReader(input), keys, notKeys) {
+		actual = append(actual, f.String())
+	}
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\nActual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestExecEnviron(t *testing.T) {
+	input := `db:
+  user: app
+  password: !crypto/age ThisIsMyReallyEncryptedPassword
+  hosts:
+  - db-1
+  - db-2
+"api.token": tok
+`
+
+	docs, err := decrypt.DecryptDocuments(nil, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{}
+	if err := exec.Environ(env, docs[0].Node, []utils.Path{{}}, "APP_"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"APP_DB_USER":     "app",
+		"APP_DB_PASSWORD": "ThisIsMyReallyEncryptedPassword",
+		"APP_DB_HOSTS_0":  "db-1",
+		"APP_DB_HOSTS_1":  "db-2",
+		"APP_API_TOKEN":   "tok",
+	}
+	if fmt.Sprint(env) != fmt.Sprint(expected) {
+		t.Errorf("Expected:\n%v\nActual:\n%v", expected, env)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	data := map[string]any{
+		"db": map[string]any{"user": "app", "password": `pa"ss`},
+	}
+	text := `user={{ .db.user | quote }} password={{ .db.password | quote }} b64={{ .db.password | b64enc }}
+db:{{ .db | toYaml | nindent 2 }}
+`
+	expected := `user="app" password="pa\"ss" b64=cGEic3M=
+db:
+  password: pa"ss
+  user: app
+`
+
+	out := bytes.NewBuffer(nil)
+	if err := template.Render(out, "test", text, data); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("Expected:\n%sActual:\n%s", expected, out.String())
+	}
+
+	if err := template.Render(io.Discard, "test", "{{ .missing.key }}", data); err == nil {
+		t.Error("Expected an error on missing keys")
+	}
+}
+
+func TestRefs(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"db.yaml":    "password: !crypto/age \"123\"\nalias: !crypto/age-ref db.yaml#.password\n",
+		"app.yaml":   "pw: !crypto/age-ref db.yaml#.alias # comment\ndsn: postgres://app:ref+yage://db.yaml#.password@db/app\n",
+		"cycle.yaml": "a: !crypto/age-ref cycle.yaml#.b\nb: !crypto/age-ref cycle.yaml#.a\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Resolved secrets keep their tag so that encrypting the output encrypts
+	// them again, unless tags are stripped.
+	for noTag, expected := range map[bool]string{
+		false: "pw: !crypto/age \"123\" # comment\ndsn: !crypto/age postgres://app:123@db/app\n",
+		true:  "pw: \"123\" # comment\ndsn: postgres://app:123@db/app\n",
+	} {
+		out := bytes.NewBuffer(nil)
+		err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, strings.NewReader(files["app.yaml"]), out, false, noTag, false, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected {
+			t.Errorf("Expected:\n%sActual:\n%s", expected, out.String())
+		}
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, strings.NewReader("db: !crypto/age-ref app.yaml#.\n"), out, false, false, false, dir); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "db:\n  pw: !crypto/age \"123\" # comment\n  dsn: !crypto/age postgres://app:123@db/app\n"; out.String() != expected {
+		t.Errorf("Expected:\n%sActual:\n%s", expected, out.String())
+	}
+
+	err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, strings.NewReader(files["cycle.yaml"]), io.Discard, false, false, false, dir)
+	if err == nil || !strings.Contains(err.Error(), "reference cycle") {
+		t.Errorf("Expected a reference cycle error, got %v", err)
+	}
+
+	// Referenced files can't be outside of the directory of the input.
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "nested.yaml"), []byte("pw: !crypto/age-ref ../db.yaml#.password\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, strings.NewReader("pw: !crypto/age-ref sub/nested.yaml#.pw\n"), out, false, true, false, dir); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "pw: \"123\"\n"; out.String() != expected {
+		t.Errorf("Expected:\n%sActual:\n%s", expected, out.String())
+	}
+	for input, expected := range map[string]string{
+		"pw: !crypto/age-ref nested.yaml#.pw\n":                                 "is outside of",
+		"pw: !crypto/age-ref ../db.yaml#.password\n":                            "is outside of",
+		"pw: x-ref+yage://../db.yaml#.password\n":                               "is outside of",
+		"pw: !crypto/age-ref " + filepath.Join(dir, "db.yaml") + "#.password\n": "absolute file name",
+	} {
+		err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, strings.NewReader(input), io.Discard, false, false, false, sub)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestK8sSecret(t *testing.T) {
+	input := `db:
+  user: app
+  password: !crypto/age ThisIsMyReallyEncryptedPassword
+`
+
+	docs, err := decrypt.DecryptDocuments(nil, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, _ := utils.ParsePath(".db")
+	values, err := k8s.SecretValues(&docs[0], []utils.Path{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := k8s.NewSecret("db", "prod", "Opaque", nil, values, false)
+	if secret.Data["password"] != "VGhpc0lzTXlSZWFsbHlFbmNyeXB0ZWRQYXNzd29yZA==" || secret.Data["user"] != "YXBw" {
+		t.Errorf("Unexpected data: %v", secret.Data)
+	}
+
+	// Binary values are written back to data unchanged.
+	secret.Data["keystore"] = base64.StdEncoding.EncodeToString([]byte{0xfe, 0xed, 0xfe, 0xed, 0x00, 0x02})
+	data := maps.Clone(secret.Data)
+
+	recipients, err := utils.ParseRecipientsFile("./testdata/yaml.pub", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := utils.ParseIdentitiesFile("./testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := k8s.FromSecret(recipients, secret, out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "ThisIsMyReallyEncryptedPassword") {
+		t.Fatal("Plaintext found in encrypted output")
+	}
+	if !strings.Contains(out.String(), "keystore: !crypto/age:Binary") {
+		t.Errorf("Binary value not tagged:\n%s", out)
+	}
+
+	docs, err = decrypt.DecryptDocuments(ids, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, namespace, typ, ok := k8s.SecretMetadata(&docs[0])
+	if !ok || name != "db" || namespace != "prod" || typ != "Opaque" {
+		t.Errorf("Unexpected metadata: %q %q %q %t", name, namespace, typ, ok)
+	}
+	back, err := k8s.SecretValues(&docs[0], []utils.Path{{{Key: "data"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := k8s.NewSecret(name, namespace, typ, nil, back, false); !maps.Equal(secret.Data, data) {
+		t.Errorf("Expected:\n%v\nActual:\n%v", data, secret.Data)
+	}
+
+	// The Binary attribute survives encrypting and decrypting in place.
+	binary := "keystore: !crypto/age:Binary " + secret.Data["keystore"] + "\n"
+	encrypted := bytes.NewBuffer(nil)
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader(binary), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	decrypted := bytes.NewBuffer(nil)
+	if err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, encrypted, decrypted, false, false, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.String() != binary {
+		t.Errorf("Expected:\n%sActual:\n%s", binary, decrypted)
+	}
+}
+
+func TestKRM(t *testing.T) {
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: db
+  data:
+    password: !crypto/age |-
+      -----BEGIN AGE ENCRYPTED FILE-----
+      YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+      OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+      amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+      alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+      gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+      -----END AGE ENCRYPTED FILE-----
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: broken
+  data:
+    key: !crypto/age |-
+      -----BEGIN AGE ENCRYPTED FILE-----
+      Zm9v
+      -----END AGE ENCRYPTED FILE-----
+`
+
+	out, failed, err := k8s.KRM([]string{"./testdata/yaml.key"}, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed {
+		t.Error("Expected the broken item to be reported")
+	}
+	if !strings.Contains(string(out), "password: VGhpc0lzTXlSZWFsbHlFbmNyeXB0ZWRQYXNzd29yZA==\n") {
+		t.Errorf("Secret data not decrypted:\n%s", out)
+	}
+	if !strings.Contains(string(out), "results:\n- message: ") || !strings.Contains(string(out), "name: broken\n") {
+		t.Errorf("Missing result:\n%s", out)
+	}
+}
+
+func TestHelm(t *testing.T) {
+	args := []string{"install", "app", "./chart", "-f", "a.yaml,b.yaml", "--values=c.yaml", "-fd.yaml", "--set", "x=1", "--", "-f", "e.yaml"}
+	want := []string{"install", "app", "./chart", "-f", "A,B", "--values=C", "-fD", "--set", "x=1", "--", "-f", "e.yaml"}
+
+	got := helm.MapValueFiles(args, func(name string) string {
+		return strings.ToUpper(strings.TrimSuffix(name, ".yaml"))
+	})
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("MapValueFiles() = %q, want %q", got, want)
+	}
+
+	identities, err := decrypt.Identities([]string{"./testdata/yaml.key"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: !crypto/age |-
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBpTmZNODFnSlAzM0F2TEs0
+    OU9iYk54T0tPN2E5OGdvVkZhVGw1anFyVEV3CjlyaE5RUkh6cStLT2V6aFJua0VD
+    amlzc3lyS09sVjZKV0FjUjZzMmVTWm8KLS0tIFFHeURlKzB4QW91WE5GZnNNdGdn
+    alEvdW5oaGVocUp5bVVTNzlQRmduZmcK66z0fR47miRVT/0t8obsCRfacNgy5T6C
+    gLJ+Nu91e/apOC85VBL/rDgbakSmfHPsCo486rDB0N3Ul0qtHT1m
+    -----END AGE ENCRYPTED FILE-----
+---
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+`
+
+	out := &bytes.Buffer{}
+	if err := helm.PostRender(identities, strings.NewReader(input), out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "password: VGhpc0lzTXlSZWFsbHlFbmNyeXB0ZWRQYXNzd29yZA==\n") {
+		t.Errorf("Secret data not decrypted:\n%s", out)
+	}
+	if strings.Count(out.String(), "---") != 1 || !strings.Contains(out.String(), "kind: ConfigMap") {
+		t.Errorf("Unexpected documents:\n%s", out)
+	}
+}
+
+func TestHelmSecretsBackendEdit(t *testing.T) {
+	if _, err := osexec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("user: app\npassword: !crypto/age s3cr3t\n"), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "secrets.yaml")
+	if err := os.WriteFile(file, encrypted.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := osexec.Command("sh", "-c", `. ./cmd/helm/helm-secrets-backend.sh && _custom_backend_edit_file auto "$1"`, "sh", file)
+	cmd.Env = append(os.Environ(),
+		"YAGE_TEST_MAIN=1",
+		"YAGE_BIN="+os.Args[0],
+		"YAGE_IDENTITY=testdata/yaml.key",
+		"YAGE_RECIPIENT_FILE=testdata/yaml.pub",
+		"EDITOR=true",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	edited, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(edited, []byte("s3cr3t")) || !bytes.Contains(edited, []byte("password: !crypto/age")) {
+		t.Fatalf("Edited file is not encrypted:\n%s", edited)
+	}
+
+	out := &bytes.Buffer{}
+	if err := decrypt.DecryptYAML([]string{"./testdata/yaml.key"}, bytes.NewReader(edited), out, false, true, false, "."); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "user: app\npassword: s3cr3t\n" {
+		t.Errorf("Unexpected decrypted file:\n%s", out)
+	}
+}
+
+func TestTerraformExternal(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "secrets.yaml")
+
+	in := "db:\n  user: app\n  password: !crypto/age s3cr3t\n  hosts: [a, b]\n"
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader(in), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, encrypted.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	query := fmt.Sprintf(`{"file": %q, "keys": "db.user,.db.password\n.db.hosts"}`, name)
+	out, err := terraform.External([]string{"./testdata/yaml.key"}, strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{".db.hosts":"[\"a\",\"b\"]",".db.password":"s3cr3t","db.user":"app"}` + "\n"
+	if string(out) != want {
+		t.Errorf("External() = %s, want %s", out, want)
+	}
+
+	query = fmt.Sprintf(`{"file": %q, "keys": ".db.missing"}`, name)
+	if _, err := terraform.External([]string{"./testdata/yaml.key"}, strings.NewReader(query)); !errors.Is(err, utils.ErrPathNotFound) {
+		t.Errorf("Expected ErrPathNotFound, got %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	aws, err := credentials.NewAWSCredentials(map[string]string{
+		"aws_access_key_id":     "AKID",
+		"aws_secret_access_key": "SECRET",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *aws != (credentials.AWSCredentials{Version: 1, AccessKeyID: "AKID", SecretAccessKey: "SECRET"}) {
+		t.Errorf("Unexpected AWS credentials: %+v", aws)
+	}
+	if _, err := credentials.NewAWSCredentials(map[string]string{"AccessKeyId": "AKID"}); err == nil {
+		t.Error("Expected an error for a missing secret access key")
+	}
+
+	kube, err := credentials.NewExecCredential(credentials.DefaultExecCredentialAPIVersion, map[string]string{
+		"client-certificate-data": "Q0VSVA==",
+		"clientKeyData":           "KEY",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kube.Kind != "ExecCredential" || kube.Status.ClientCertificateData != "CERT" || kube.Status.ClientKeyData != "KEY" {
+		t.Errorf("Unexpected ExecCredential: %+v", kube.Status)
+	}
+	if _, err := credentials.NewExecCredential(credentials.DefaultExecCredentialAPIVersion, map[string]string{"clientKeyData": "KEY"}); err == nil {
+		t.Error("Expected an error for a key without certificate")
+	}
+}
+
+func TestCredentialStore(t *testing.T) {
+	pub, err := os.ReadFile("testdata/yaml.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := credentials.NewStore([]string{strings.TrimSpace(string(pub))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "credentials.yaml")
+	if err := os.WriteFile(name, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := credentials.OpenStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"reg.io", "https://index.docker.io/v1/"} {
+		if err := store.Put(credentials.DockerSection, key, credentials.Entry{Username: "me", Secret: "s3cr3t " + key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	identities, err := decrypt.Identities([]string{"./testdata/yaml.key"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store, err = credentials.OpenStore(name); err != nil {
+		t.Fatal(err)
+	}
+	e, err := store.Get(identities, credentials.DockerSection, "reg.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || *e != (credentials.Entry{Username: "me", Secret: "s3cr3t reg.io"}) {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	for key := range store.List(credentials.DockerSection) {
+		if err := store.Erase(credentials.DockerSection, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := os.ReadFile(name); string(got) != string(content) {
+		t.Errorf("Expected an empty store, got:\n%s", got)
+	}
+
+	attrs, err := credentials.ReadGitCredential(strings.NewReader("url=https://bob@github.com/sylr/yage.git\n\nignored=1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := credentials.GitKey(attrs); err != nil || key != "https://github.com/sylr/yage.git" || attrs["username"] != "bob" {
+		t.Errorf("Unexpected git credential %v: %q, %v", attrs, key, err)
+	}
+}
+
+func TestDecryptToDir(t *testing.T) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal([]byte("db:\n  user: app\n  password: s3cr3t\nhosts: [a, b]\n"), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := decrypt.DirFiles(&doc, []utils.Path{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"db.user": "app", "db.password": "s3cr3t", "hosts.0": "a", "hosts.1": "b"}
+	if fmt.Sprint(files) != fmt.Sprint(want) {
+		t.Errorf("DirFiles() = %v, want %v", files, want)
+	}
+
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other"), []byte("kept"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt.ToDir(dir, files, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	password := utils.Path{{Key: "db"}, {Key: "password"}}
+	if files, err = decrypt.DirFiles(&doc, []utils.Path{password}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt.ToDir(dir, files, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, " ") != ".yage-files other password" {
+		t.Errorf("Unexpected files: %v", names)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o400 {
+		t.Errorf("Unexpected mode %v", info.Mode())
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := decrypt.ToDir(dir, files, -1, -1); err == nil {
+			t.Error("Expected world-writable directory to be refused")
+		}
+	}
+}
+
+func TestKMSPlugin(t *testing.T) {
+	pub, err := os.ReadFile("testdata/yaml.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := utils.ParseIdentitiesFile("testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, err := kms.NewPlugin(identities, []string{strings.TrimSpace(string(pub))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "kms.sock")
+	ln, err := utils.ListenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- plugin.Serve(ctx, ln, time.Second) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := grpc.NewClient("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := kmsapi.NewKeyManagementServiceClient(conn)
+
+	status, err := client.Status(ctx, &kmsapi.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "v2" || status.Healthz != "ok" || status.KeyId != kms.KeyID([]string{string(pub)}) {
+		t.Errorf("Unexpected status: %v", status)
+	}
+
+	dek := []byte("0123456789abcdef0123456789abcdef")
+	encrypted, err := client.Encrypt(ctx, &kmsapi.EncryptRequest{Plaintext: dek, Uid: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.KeyId != status.KeyId || bytes.Contains(encrypted.Ciphertext, dek) {
+		t.Errorf("Unexpected encrypt response: %v", encrypted)
+	}
+
+	decrypted, err := client.Decrypt(ctx, &kmsapi.DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId, Uid: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Plaintext, dek) {
+		t.Errorf("Decrypt() = %q, want %q", decrypted.Plaintext, dek)
+	}
+}
+
+func TestCSIProvider(t *testing.T) {
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.EncryptYAML(recipients, strings.NewReader("user: app\npassword: !crypto/age s3cr3t\n"), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := yaml.Marshal([]csi.Object{
+		{ObjectName: "db.yaml", YAML: encrypted.String(), Paths: []csi.ObjectPath{{Path: ".password", FileName: "password", Mode: "0400"}}},
+		{ObjectName: "db.yaml", YAML: encrypted.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := json.Marshal(map[string]string{"objects": string(objects), "csi.storage.k8s.io/pod.name": "app", csi.NamespaceAttribute: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only pods of namespace prod can decrypt.
+	identityDir := t.TempDir()
+	key, err := os.ReadFile("testdata/yaml.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(identityDir, "prod"), key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "csi.sock")
+	ln, err := utils.ListenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- csi.NewProvider(nil, identityDir).Serve(ctx, ln, time.Second) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := grpc.NewClient("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := v1alpha1.NewCSIDriverProviderClient(conn)
+
+	version, err := client.Version(ctx, &v1alpha1.VersionRequest{Version: "v1alpha1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "v1alpha1" || version.RuntimeName != "yage" {
+		t.Errorf("Unexpected version: %+v", version)
+	}
+
+	res, err := client.Mount(ctx, &v1alpha1.MountRequest{Attributes: string(attributes), TargetPath: "/tmp", Permission: "420"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 2 || len(res.ObjectVersion) != 2 {
+		t.Fatalf("Unexpected response: %+v", res)
+	}
+	if f := res.Files[0]; f.Path != "password" || f.Mode != 0o400 || string(f.Contents) != "s3cr3t" {
+		t.Errorf("Unexpected file: %+v", f)
+	}
+	if f := res.Files[1]; f.Path != "db.yaml" || f.Mode != 0o644 || string(f.Contents) != "user: app\npassword: s3cr3t\n" {
+		t.Errorf("Unexpected file: %+v %q", f, f.Contents)
+	}
+
+	for _, tc := range []struct {
+		namespace string
+		objects   string
+		code      codes.Code
+	}{
+		{"prod", "- objectName: ../escape\n  yaml: 'a: b'\n", codes.InvalidArgument},
+		{"staging", string(objects), codes.PermissionDenied},
+		{"", string(objects), codes.InvalidArgument},
+		{"../prod", string(objects), codes.InvalidArgument},
+	} {
+		attributes, _ = json.Marshal(map[string]string{"objects": tc.objects, csi.NamespaceAttribute: tc.namespace})
+		_, err = client.Mount(ctx, &v1alpha1.MountRequest{Attributes: string(attributes)})
+		if status.Code(err) != tc.code {
+			t.Errorf("namespace %q: expected %v, got %v", tc.namespace, tc.code, err)
+		}
+	}
+}
+
+func TestAgent(t *testing.T) {
+	if _, err := utils.PeerUID(nil); errors.Is(err, utils.ErrPeerCredentialsUnsupported) {
+		t.Skip(err)
+	}
+
+	identities, err := utils.ParseIdentitiesFile("testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Unlock(identities); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := utils.ListenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- agent.NewAgent(identities).Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &bytes.Buffer{}
+	if err := encrypt.Encrypt(recipients, strings.NewReader("s3cr3t"), encrypted, false); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(utils.AgentSocketEnv, sock)
+	out := &bytes.Buffer{}
+	if err := decrypt.Decrypt(nil, bytes.NewReader(encrypted.Bytes()), out, false); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "s3cr3t" {
+		t.Errorf("Decrypt() = %q, want %q", out, "s3cr3t")
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted.Reset()
+	if err := encrypt.Encrypt([]age.Recipient{other.Recipient()}, strings.NewReader("s3cr3t"), encrypted, false); err != nil {
+		t.Fatal(err)
+	}
+	var noMatch *age.NoIdentityMatchError
+	if _, err := age.Decrypt(encrypted, &utils.AgentIdentity{Socket: sock}); !errors.As(err, &noMatch) {
+		t.Errorf("Expected NoIdentityMatchError, got %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	recipients, err := encrypt.Recipients(nil, []string{"./testdata/yaml.pub"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	write := func(in string) {
+		encrypted := &bytes.Buffer{}
+		if err := encrypt.EncryptYAML(recipients, strings.NewReader(in), encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, encrypted.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`db:
+  user: app
+  password: !crypto/age s3cr3t
+admin: &admin !crypto/age root
+internal: &internal
+  key: !crypto/age k
+leak:
+  root: *admin
+merged:
+  <<: *internal
+via: *internal
+local:
+  a: &a v
+  b: *a
+`)
+
+	identities, err := utils.ParseIdentitiesFile("testdata/yaml.key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := serve.NewServer(identities, map[string]string{"app": file}, []string{"app/.db", "app/.leak", "app/.merged", "app/.via", "app/.local"}, "t0ken", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(target, token string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	tests := []struct {
+		target string
+		token  string
+		code   int
+		body   string
+	}{
+		{"/v1/secrets/app/db/password", "t0ken", http.StatusOK, "s3cr3t"},
+		{"/v1/secrets/app/.db.password", "t0ken", http.StatusOK, "s3cr3t"},
+		{"/v1/secrets/app/db", "t0ken", http.StatusOK, `{"password":"s3cr3t","user":"app"}` + "\n"},
+		{"/v1/secrets/app/db/password", "", http.StatusUnauthorized, ""},
+		{"/v1/secrets/app/db/password", "wrong", http.StatusUnauthorized, ""},
+		{"/v1/secrets/app/admin", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/.", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/db/missing", "t0ken", http.StatusNotFound, ""},
+		{"/v1/secrets/other/db", "t0ken", http.StatusNotFound, ""},
+		// Aliases are only followed to allowed values.
+		{"/v1/secrets/app/leak", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/leak/root", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/merged", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/via", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/via/key", "t0ken", http.StatusForbidden, ""},
+		{"/v1/secrets/app/local", "t0ken", http.StatusOK, `{"a":"v","b":"v"}` + "\n"},
+		{"/v1/secrets/app/local/b", "t0ken", http.StatusOK, "v"},
+	}
+	for _, tt := range tests {
+		code, body := fetch(tt.target, tt.token)
+		if code != tt.code || (tt.body != "" && body != tt.body) {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.target, code, body, tt.code, tt.body)
+		}
+	}
+
+	write("db:\n  password: !crypto/age changed\n")
+	if _, body := fetch("/v1/secrets/app/db/password", "t0ken"); body != "changed" {
+		t.Errorf("Expected reloaded value, got %q", body)
+	}
+
+	if _, err := serve.NewServer(identities, map[string]string{"app": file}, []string{"other/.db"}, "", nil); err == nil {
+		t.Error("Expected error for allowed path of unknown file")
+	}
+}
+
+func TestDecryptWatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.yaml")
+	if err := os.WriteFile(file, []byte("a: b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := make(chan struct{}, 10)
+	notified := make(chan struct{}, 10)
+	watched := make(chan error)
+	go func() {
+		watched <- decrypt.Watch(ctx, []string{file},
+			func() error { runs <- struct{}{}; return nil },
+			func() error { notified <- struct{}{}; return nil },
+		)
+	}()
+	defer func() {
+		cancel()
+		if err := <-watched; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	wait := func(c chan struct{}, what string) {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+
+	wait(runs, "first run")
+	select {
+	case <-notified:
+		t.Error("Unexpected notification after first run")
+	case <-time.After(2 * decrypt.WatchDelay):
+	}
+
+	// Replace the file like editors do.
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte("a: c\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+	wait(runs, "run after change")
+	wait(notified, "notification after change")
+}
+
+func TestDecryptWatchSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+
+	// Lay files out as Kubernetes does for Secret volumes.
+	dir := t.TempDir()
+	for _, v := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(dir, v), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, v, "secrets.yaml"), []byte("v: "+v+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "secrets.yaml")
+	if err := os.Symlink(filepath.Join("..data", "secrets.yaml"), file); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	contents := make(chan string, 10)
+	watched := make(chan error)
+	go func() {
+		watched <- decrypt.Watch(ctx, []string{file}, func() error {
+			b, err := os.ReadFile(file)
+			contents <- string(b)
+			return err
+		}, nil)
+	}()
+	defer func() {
+		cancel()
+		if err := <-watched; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	wait := func(expected string) {
+		select {
+		case c := <-contents:
+			if c != expected {
+				t.Fatalf("Read %q, expected %q", c, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+
+	wait("v: ..v1\n")
+
+	// Swap the ..data symlink.
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink("..v2", tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	wait("v: ..v2\n")
+
+	// Files the symlinks point to are watched too.
+	if err := os.WriteFile(filepath.Join(dir, "..v2", "secrets.yaml"), []byte("v: changed\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	wait("v: changed\n")
+}